@@ -0,0 +1,124 @@
+// Command merklelog-fs-migrate moves or hard links logs between the on disk
+// layouts supported by the fs store.
+//
+// Usage:
+//
+//	merklelog-fs-migrate -root <dir> -from tenant -to log [-move] [-dry-run] [-log <id>]...
+//
+// Running the same migration again resumes it. The exit status is non zero
+// if any object is in conflict, or fails verification.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+var layouts = map[string]func() fsstorage.PrefixProvider{
+	"log":    fsstorage.NewPrefixProvider,
+	"tenant": fsstorage.NewDatatrailsPrefixProvider,
+	"blob":   fsstorage.NewDatatrailsBlobPrefixProvider,
+}
+
+type logIDsFlag []storage.LogID
+
+func (f *logIDsFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *logIDsFlag) Set(value string) error {
+	logID, err := fsstorage.DirName2LogID(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, logID)
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var logIDs logIDsFlag
+	rootDir := flag.String("root", ".", "the root directory holding the logs")
+	from := flag.String("from", "tenant", "the layout to migrate from: log, tenant or blob")
+	to := flag.String("to", "log", "the layout to migrate to: log, tenant or blob")
+	move := flag.Bool("move", false, "move the objects, rather than hard linking them")
+	dryRun := flag.Bool("dry-run", false, "verify and report without changing anything")
+	massifHeight := flag.Uint("massif-height", fsstorage.DefaultMassifHeight, "the massif height of the logs")
+	verbose := flag.Bool("v", false, "report every object, not just the problems")
+	flag.Var(&logIDs, "log", "a log id to migrate, may be repeated. All logs are migrated if not given")
+	flag.Parse()
+
+	if *massifHeight < 1 || *massifHeight > 64 {
+		return fmt.Errorf("invalid massif height %d, it must be between 1 and 64", *massifHeight)
+	}
+	newFrom, ok := layouts[*from]
+	if !ok {
+		return fmt.Errorf("unknown layout %q", *from)
+	}
+	newTo, ok := layouts[*to]
+	if !ok {
+		return fmt.Errorf("unknown layout %q", *to)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{
+		StorageOptions: massifs.StorageOptions{MassifHeight: uint8(*massifHeight)},
+		FSOptions:      fsstorage.FSOptions{RootDir: *rootDir},
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	opts := fsstorage.MigrateOptions{
+		From:   newFrom(),
+		To:     newTo(),
+		DryRun: *dryRun,
+		LogIDs: logIDs,
+	}
+	if *move {
+		opts.Mode = fsstorage.MigrateMove
+	}
+
+	result, err := store.Migrate(ctx, opts)
+	for _, item := range result.Items {
+		if *verbose || item.Outcome == fsstorage.MigrateConflict || item.Outcome == fsstorage.MigrateInvalid {
+			fmt.Println(item)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var summary []string
+	for _, outcome := range []fsstorage.MigrateOutcome{
+		fsstorage.MigrateTransferred, fsstorage.MigrateAlreadyPresent, fsstorage.MigrateConflict, fsstorage.MigrateInvalid,
+	} {
+		summary = append(summary, fmt.Sprintf("%d %v", result.Count(outcome), outcome))
+	}
+	if *dryRun {
+		summary = append(summary, "(dry run)")
+	}
+	fmt.Println(strings.Join(summary, ", "))
+
+	if n := result.Count(fsstorage.MigrateConflict) + result.Count(fsstorage.MigrateInvalid); n > 0 {
+		return fmt.Errorf("%d objects were not migrated", n)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// tryAppend writes only the tail of data to storagePath when data extends the
+// content already on disk.
+//
+// The bytes cached in LogCache.MassifData are trusted as the on-disk prefix
+// only if the file size matches their length exactly. PopulateCache caches
+// just the start header, so a massif must have been read in full, or written
+// by this store, before it can be extended. Returns false, and writes
+// nothing, whenever a full rewrite is required instead.
+//
+// Unlike writeAtomic, a crash part way through an append can leave a torn
+// tail. The previously committed prefix is never modified, but nothing here
+// detects the partial tail. If RecoveryPolicy is set, the recovery pass run
+// by PopulateCache reports a massif whose size ends part way through a
+// value, see massifSizeDetail, and RecoveryRepair truncates it to its last
+// complete value. A tail torn on a value boundary is not detected.
+func (s *CachingStore) tryAppend(storagePath string, data []byte) (bool, error) {
+
+	ao, ok := s.Opts.WriteOpener.(AppendWriteOpener)
+	if !ok {
+		return false, nil
+	}
+
+	cached, ok := s.Selected.MassifData[storagePath]
+	if !ok || len(cached) == 0 || len(cached) >= len(data) || !bytes.HasPrefix(data, cached) {
+		return false, nil
+	}
+
+	stat, err := os.Stat(storagePath)
+	if err != nil || stat.Size() != int64(len(cached)) {
+		return false, nil
+	}
+
+	f, err := ao.OpenAppend(storagePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s for append: %w", storagePath, err)
+	}
+	if err = writeAndSync(f, data[len(cached):]); err != nil {
+		return false, fmt.Errorf("failed to append to %s: %w", storagePath, err)
+	}
+	return true, nil
+}
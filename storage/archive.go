@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReadOnly = errors.New("the store is read only")
+)
+
+// Archive provides read only access to the files in a tar or zip archive,
+// as if the archive were a directory with the same layout. Paths are
+// resolved relative to the archive path, so a root dir of "logs.tar" serves
+// "logs.tar/log/<uuid>/massifs/0000000000000000.log" from the member
+// "log/<uuid>/massifs/0000000000000000.log".
+//
+// Archive implements Opener, ReaderAtOpener and DirLister. It is safe for
+// concurrent use.
+type Archive struct {
+	path    string
+	file    *os.File
+	entries map[string]*archiveEntry
+	// dirs maps each directory, including the implicit ones, to the names of its children
+	dirs map[string]map[string]bool
+}
+
+type archiveEntry struct {
+	info fs.FileInfo
+	// offset is the position of the content in a tar archive, or of a stored zip member
+	offset int64
+	// zf is set for zip members
+	zf *zip.File
+}
+
+// OpenArchive indexes the tar or zip archive at archivePath. The format is
+// detected from the content.
+func OpenArchive(archivePath string) (*Archive, error) {
+	abs, err := filepath.Abs(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		path:    abs,
+		file:    f,
+		entries: make(map[string]*archiveEntry),
+		dirs:    map[string]map[string]bool{".": {}},
+	}
+
+	var magic [4]byte
+	n, _ := f.ReadAt(magic[:], 0)
+	if n == len(magic) && bytes.Equal(magic[:2], []byte("PK")) {
+		err = a.indexZip()
+	} else {
+		err = a.indexTar()
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to index archive %s: %w", archivePath, err)
+	}
+	return a, nil
+}
+
+// Path returns the absolute path of the archive, which serves as the root dir for its content
+func (a *Archive) Path() string {
+	return a.path
+}
+
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+// countingReader tracks the position in the archive file as the tar reader consumes it
+type countingReader struct {
+	f   *os.File
+	pos int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+func (a *Archive) indexTar() error {
+	r := &countingReader{f: a.file}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// The content of a regular entry follows its header
+			a.add(hdr.Name, &archiveEntry{info: hdr.FileInfo(), offset: r.pos})
+		case tar.TypeDir:
+			a.addDir(hdr.Name)
+		}
+	}
+}
+
+func (a *Archive) indexZip() error {
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(a.file, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			a.addDir(zf.Name)
+			continue
+		}
+		e := &archiveEntry{info: zf.FileInfo(), zf: zf, offset: -1}
+		if zf.Method == zip.Store {
+			if e.offset, err = zf.DataOffset(); err != nil {
+				return err
+			}
+		}
+		a.add(zf.Name, e)
+	}
+	return nil
+}
+
+func (a *Archive) add(name string, e *archiveEntry) {
+	member := path.Clean(strings.TrimPrefix(name, "/"))
+	a.entries[member] = e
+	a.addChild(member)
+}
+
+func (a *Archive) addDir(name string) {
+	member := path.Clean(strings.TrimPrefix(name, "/"))
+	if _, ok := a.dirs[member]; !ok {
+		a.dirs[member] = make(map[string]bool)
+	}
+	if member != "." {
+		a.addChild(member)
+	}
+}
+
+// addChild records the member in its parent directory, creating any implicit directories
+func (a *Archive) addChild(member string) {
+	for member != "." {
+		parent := path.Dir(member)
+		children, ok := a.dirs[parent]
+		if !ok {
+			children = make(map[string]bool)
+			a.dirs[parent] = children
+		}
+		children[path.Base(member)] = true
+		member = parent
+	}
+}
+
+// member returns the archive member name for a path under the archive path
+func (a *Archive) member(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(a.path, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (a *Archive) entry(name string) (*archiveEntry, error) {
+	member, err := a.member(name)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := a.entries[member]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// archiveReader is an opened archive member. It provides the member's FileInfo through Stat.
+type archiveReader struct {
+	io.Reader
+	io.ReaderAt
+	close func() error
+	info  fs.FileInfo
+}
+
+func (r *archiveReader) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+func (r *archiveReader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+// Open opens the archive member at the path for reading
+func (a *Archive) Open(name string) (io.ReadCloser, error) {
+	e, err := a.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.offset < 0 {
+		rc, err := e.zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		return &archiveReader{Reader: rc, close: rc.Close, info: e.info}, nil
+	}
+	sr := io.NewSectionReader(a.file, e.offset, e.info.Size())
+	return &archiveReader{Reader: sr, ReaderAt: sr, info: e.info}, nil
+}
+
+// OpenReaderAt opens the archive member at the path for random access
+// reads. Compressed zip members are decompressed into memory.
+func (a *Archive) OpenReaderAt(name string) (ReaderAtCloser, error) {
+	e, err := a.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.offset < 0 {
+		rc, err := e.zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		br := bytes.NewReader(data)
+		return &archiveReader{Reader: br, ReaderAt: br, info: e.info}, nil
+	}
+	sr := io.NewSectionReader(a.file, e.offset, e.info.Size())
+	return &archiveReader{Reader: sr, ReaderAt: sr, info: e.info}, nil
+}
+
+// ListFiles returns the paths of the files (not subdirectories) in the archive directory
+func (a *Archive) ListFiles(name string) ([]string, error) {
+	entries, err := a.ReadDir(name)
+	if err != nil {
+		return []string{}, err
+	}
+	dir, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			result = append(result, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return result, nil
+}
+
+// ReadDir returns the entries of the archive directory, sorted by name, as os.ReadDir does
+func (a *Archive) ReadDir(name string) ([]fs.DirEntry, error) {
+	member, err := a.member(name)
+	if err != nil {
+		return nil, err
+	}
+	children, ok := a.dirs[member]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	names := make([]string, 0, len(children))
+	for child := range children {
+		names = append(names, child)
+	}
+	slices.Sort(names)
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, child := range names {
+		childMember := path.Join(member, child)
+		if e, ok := a.entries[childMember]; ok {
+			entries = append(entries, fs.FileInfoToDirEntry(e.info))
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(archiveDirInfo(child)))
+	}
+	return entries, nil
+}
+
+// archiveDirInfo describes a directory of the archive, which may only be implied by the member names
+type archiveDirInfo string
+
+func (d archiveDirInfo) Name() string       { return string(d) }
+func (d archiveDirInfo) Size() int64        { return 0 }
+func (d archiveDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d archiveDirInfo) ModTime() time.Time { return time.Time{} }
+func (d archiveDirInfo) IsDir() bool        { return true }
+func (d archiveDirInfo) Sys() any           { return nil }
+
+// openArchive serves the store from an archive if one is configured, or if
+// the root dir is an archive file rather than a directory.
+func (s *CachingStore) openArchive() error {
+	if s.Opts.Archive == nil && s.Opts.RootDir != "" {
+		info, err := os.Stat(s.Opts.RootDir)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if s.Opts.Archive, err = OpenArchive(s.Opts.RootDir); err != nil {
+			return err
+		}
+		s.ownsArchive = true
+	}
+	if s.Opts.Archive == nil {
+		return nil
+	}
+	s.Opts.RootDir = s.Opts.Archive.Path()
+	s.Opts.ReadOpener = s.Opts.Archive
+	s.Opts.DirLister = s.Opts.Archive
+	return nil
+}
+
+// readDir lists a directory under the root dir, which may be in an archive
+func (s *CachingStore) readDir(name string) ([]fs.DirEntry, error) {
+	if s.Opts.Archive != nil {
+		return s.Opts.Archive.ReadDir(name)
+	}
+	return os.ReadDir(name)
+}
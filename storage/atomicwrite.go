@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// TempFileSuffix marks the sibling files Put writes before renaming them
+	// over their final names. Files with this suffix are never listed as
+	// massifs or checkpoints.
+	TempFileSuffix = ".tmp"
+)
+
+var tempFileSeq atomic.Uint64
+
+// syncer is satisfied by *os.File, and by any WriteOpener result able to
+// flush its content to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// tempPath returns a unique, hidden, sibling path for storagePath.
+// The pid and a process wide sequence number make it unique across concurrent writers.
+func tempPath(storagePath string) string {
+	dir, base := filepath.Split(storagePath)
+	seq := tempFileSeq.Add(1)
+	return filepath.Join(dir, "."+base+"."+strconv.Itoa(os.Getpid())+"."+strconv.FormatUint(seq, 10)+TempFileSuffix)
+}
+
+// IsTempFile returns true if the path names a file created by writeAtomic
+func IsTempFile(storagePath string) bool {
+	base := filepath.Base(storagePath)
+	return len(base) > len(TempFileSuffix) && base[0] == '.' && filepath.Ext(base) == TempFileSuffix
+}
+
+// targetPath returns the path a temporary file created by tempPath is written
+// for, or the path itself if it is not a temporary file.
+func targetPath(storagePath string) string {
+	if !IsTempFile(storagePath) {
+		return storagePath
+	}
+	dir, base := filepath.Split(storagePath)
+	base = strings.TrimSuffix(base[1:], TempFileSuffix)
+	// strip the pid and sequence number
+	for range 2 {
+		i := strings.LastIndexByte(base, '.')
+		if i < 0 {
+			return storagePath
+		}
+		base = base[:i]
+	}
+	return filepath.Join(dir, base)
+}
+
+// writeAtomic replaces the content at storagePath so that readers only ever
+// observe the previous content or the complete new content.
+//
+// The data is written to a temporary sibling file, which is synced and then
+// renamed over storagePath. The parent directory is synced last so that the
+// rename itself is durable. If failIfExists is true, the temporary file is
+// hard linked to storagePath instead. Linking never replaces an existing
+// file, so the exclusive semantics of O_EXCL are preserved without exposing
+// a partially written file under the final name.
+func (s *CachingStore) writeAtomic(storagePath string, data []byte, failIfExists bool) (err error) {
+
+	tmp := tempPath(storagePath)
+
+	f, err := s.Opts.WriteOpener.OpenCreate(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to open temporary file %s for writing: %w", tmp, err)
+	}
+	defer func() {
+		// On success the temporary name has been renamed or unlinked already
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if err = writeAndSync(f, data); err != nil {
+		return fmt.Errorf("failed to write data to temporary file %s: %w", tmp, err)
+	}
+
+	if failIfExists {
+		if err = os.Link(tmp, storagePath); err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", tmp, storagePath, err)
+		}
+		if err = os.Remove(tmp); err != nil {
+			return fmt.Errorf("failed to remove temporary file %s: %w", tmp, err)
+		}
+	} else {
+		if err = os.Rename(tmp, storagePath); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", tmp, storagePath, err)
+		}
+	}
+
+	if err = syncDir(filepath.Dir(storagePath)); err != nil {
+		return fmt.Errorf("failed to sync directory for %s: %w", storagePath, err)
+	}
+	return nil
+}
+
+// writeAndSync writes all of data to w, syncs it if it supports that, and closes it.
+func writeAndSync(w io.WriteCloser, data []byte) error {
+	n, err := w.Write(data)
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		if sw, ok := w.(syncer); ok {
+			err = sw.Sync()
+		}
+	}
+	return errors.Join(err, w.Close())
+}
+
+// syncDir flushes the directory entry changes for dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return errors.Join(err, d.Close())
+}
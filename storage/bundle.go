@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	// BundleManifestName is the name of the manifest, which is the first member of a bundle
+	BundleManifestName = "bundle.json"
+	bundleVersion      = 1
+
+	bundleMassifsDir     = "massifs/"
+	bundleCheckpointsDir = "checkpoints/"
+
+	// maxBundleManifestSize bounds the manifest read by Import, it allows
+	// for hundreds of thousands of objects
+	maxBundleManifestSize = 64 << 20
+)
+
+var (
+	ErrInvalidBundle  = errors.New("invalid log bundle")
+	ErrBundleConflict = errors.New("the log already has different content for an object in the bundle")
+)
+
+// BundleManifest describes the content of a log bundle written by Export.
+// Every object in the bundle is listed, with its size and SHA-256 digest.
+type BundleManifest struct {
+	Version int `json:"version"`
+	// LogID is hex encoded
+	LogID        string `json:"logId"`
+	MassifHeight uint8  `json:"massifHeight"`
+	// FirstMassif and HeadMassif, and FirstSeal and HeadSeal, are the index
+	// ranges of the massifs and checkpoints in the bundle. They are only
+	// meaningful if there are any.
+	FirstMassif uint32 `json:"firstMassif"`
+	HeadMassif  uint32 `json:"headMassif"`
+	FirstSeal   uint32 `json:"firstSeal"`
+	HeadSeal    uint32 `json:"headSeal"`
+
+	Massifs     []BundleEntry `json:"massifs"`
+	Checkpoints []BundleEntry `json:"checkpoints"`
+}
+
+type BundleEntry struct {
+	MassifIndex uint32 `json:"massifIndex"`
+	// Name is the name of the bundle member holding the object
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// IndexRange is an inclusive range of massif indices
+type IndexRange struct {
+	First uint32
+	Last  uint32
+}
+
+func (r IndexRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%d", r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+func (r *IndexRange) contains(massifIndex uint32) bool {
+	return r == nil || (massifIndex >= r.First && massifIndex <= r.Last)
+}
+
+type ExportOptions struct {
+	// Range limits the export to the massifs, and checkpoints, in the range. Nil exports the whole log.
+	Range *IndexRange
+}
+
+type ImportOptions struct {
+	// LogID imports the bundle into a different log. If nil, the log id in the bundle manifest is used.
+	LogID storage.LogID
+}
+
+// Export writes the massifs and checkpoints of the log to w, as a tar
+// bundle. The first member is the bundle manifest, followed by the
+// checkpoints and then the massifs, in index order. Objects are written
+// uncompressed, whatever their form on disk.
+//
+// The log is activated as it is by Log, and the objects are read through
+// its cache, so lazily discovered objects are verified as they are read.
+// The lock for the log is held only while the objects are read, never while
+// they are written to w, so a slow writer does not hold up other users of
+// the log. With a Range, the objects are read once and held in memory until
+// they are written, Range bounds the size of each bundle. Without one, the
+// log is read to make the manifest, and each object is read again as it is
+// written, and checked against the manifest. Only the objects of the head
+// massif, which may still change, are held from the first read.
+func (s *CachingStore) Export(ctx context.Context, logId storage.LogID, w io.Writer, opts ExportOptions) (*BundleManifest, error) {
+	m, objects, err := s.collectBundle(ctx, logId, opts)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+	if err := writeBundleMember(tw, BundleManifestName, manifest, modTime); err != nil {
+		return nil, err
+	}
+	for _, members := range []struct {
+		ty      storage.ObjectType
+		entries []BundleEntry
+	}{
+		{storage.ObjectCheckpoint, m.Checkpoints},
+		{storage.ObjectMassifData, m.Massifs},
+	} {
+		for _, e := range members.entries {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			data, ok := objects[e.Name]
+			if !ok {
+				if data, err = s.rereadBundleObject(ctx, logId, e, members.ty); err != nil {
+					return nil, err
+				}
+			}
+			if err := writeBundleMember(tw, e.Name, data, modTime); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish the bundle: %w", err)
+	}
+	return m, nil
+}
+
+// rereadBundleObject reads an object for Export a second time, under the
+// lock for the log, and checks it is the object recorded in the manifest.
+// Only the bytes recorded are read from a massif, so a massif grown since
+// the first read still matches.
+func (s *CachingStore) rereadBundleObject(ctx context.Context, logId storage.LogID, e BundleEntry, ty storage.ObjectType) ([]byte, error) {
+	ls := s.logStore(logId)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.activate(ctx, logId); err != nil {
+		return nil, err
+	}
+	var data []byte
+	var err error
+	if ty == storage.ObjectMassifData {
+		data, err = ls.MassifReadN(ctx, e.MassifIndex, int(e.Size))
+	} else {
+		data, err = ls.CheckpointRead(ctx, e.MassifIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := e.check(data); err != nil {
+		return nil, fmt.Errorf("%v for massif %d changed during the export: %v", ty, e.MassifIndex, err)
+	}
+	return data, nil
+}
+
+// collectBundle reads the objects to export, under the lock for the log,
+// returning the manifest and the object content keyed by member name. If
+// there is no range, only the content of the head massif is returned.
+func (s *CachingStore) collectBundle(ctx context.Context, logId storage.LogID, opts ExportOptions) (*BundleManifest, map[string][]byte, error) {
+	ls := s.logStore(logId)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.activate(ctx, logId); err != nil {
+		return nil, nil, err
+	}
+
+	m := &BundleManifest{
+		Version:      bundleVersion,
+		LogID:        hex.EncodeToString(logId),
+		MassifHeight: ls.Opts.StorageOptions.MassifHeight,
+	}
+	objects := make(map[string][]byte)
+	for _, massifIndex := range slices.Sorted(maps.Keys(ls.Selected.MassifPaths)) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if !opts.Range.contains(massifIndex) {
+			continue
+		}
+		paths := ls.Selected.MassifPaths[massifIndex]
+		for _, ty := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+			if (ty == storage.ObjectMassifData && paths.Data == "") || (ty == storage.ObjectCheckpoint && paths.Checkpoint == "") {
+				continue
+			}
+			data, err := ls.readObject(ctx, massifIndex, ty)
+			if err != nil {
+				return nil, nil, err
+			}
+			name, err := m.add(logId, massifIndex, ty, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if opts.Range != nil || massifIndex == ls.Selected.HeadMassifIndex {
+				// The cached data may be replaced, but is never modified, once the lock is released
+				objects[name] = data
+			}
+		}
+	}
+	return m, objects, nil
+}
+
+// Import reads a bundle written by Export, and puts its objects into the
+// log named by its manifest, or by opts. The manifest is checked against the
+// store's massif height, and each object against its size and digest in the
+// manifest, and against the member name recorded for its massif index,
+// before it is put. Massifs are also checked against the index in their
+// start header.
+//
+// The checkpoints precede the massifs in the bundle, and are held until the
+// massifs have been put. Each checkpoint's MMRSize is checked against its
+// massif index before anything is put, and against the data of its massif,
+// from the bundle or the log, before that massif is put.
+//
+// Objects the log already has with the same content are skipped, so an
+// interrupted import is resumed by importing the bundle again. An object the
+// log has with different content fails the import with ErrBundleConflict.
+func (s *CachingStore) Import(ctx context.Context, r io.Reader, opts ImportOptions) (*BundleManifest, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read the manifest: %v", ErrInvalidBundle, err)
+	}
+	if hdr.Name != BundleManifestName {
+		return nil, fmt.Errorf("%w: the first member is %s, not the manifest", ErrInvalidBundle, hdr.Name)
+	}
+	if hdr.Size > maxBundleManifestSize {
+		return nil, fmt.Errorf("%w: the manifest is %d bytes, the limit is %d", ErrInvalidBundle, hdr.Size, maxBundleManifestSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(tr, maxBundleManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read the manifest: %v", ErrInvalidBundle, err)
+	}
+	m := &BundleManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode the manifest: %v", ErrInvalidBundle, err)
+	}
+	if m.Version != bundleVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, m.Version)
+	}
+	if m.MassifHeight != s.Opts.StorageOptions.MassifHeight {
+		return nil, fmt.Errorf("%w: massif height %d does not match the store's %d",
+			ErrInvalidBundle, m.MassifHeight, s.Opts.StorageOptions.MassifHeight)
+	}
+	bundleLogId, err := hex.DecodeString(m.LogID)
+	if err != nil || len(bundleLogId) == 0 {
+		return nil, fmt.Errorf("%w: invalid log id %q", ErrInvalidBundle, m.LogID)
+	}
+	logId := opts.LogID
+	if logId == nil {
+		logId = bundleLogId
+	}
+
+	type member struct {
+		entry BundleEntry
+		ty    storage.ObjectType
+	}
+	pending := make(map[string]member)
+	for _, members := range []struct {
+		ty      storage.ObjectType
+		entries []BundleEntry
+	}{
+		{storage.ObjectMassifData, m.Massifs},
+		{storage.ObjectCheckpoint, m.Checkpoints},
+	} {
+		for _, e := range members.entries {
+			// The name Export gives the object, so an entry can not put it at another index
+			name, err := bundleMemberName(bundleLogId, e.MassifIndex, members.ty)
+			if err != nil || name != e.Name {
+				return nil, fmt.Errorf("%w: %s is not the member for massif %d, type %v", ErrInvalidBundle, e.Name, e.MassifIndex, members.ty)
+			}
+			if _, ok := pending[e.Name]; ok {
+				return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidBundle, e.Name)
+			}
+			pending[e.Name] = member{e, members.ty}
+		}
+	}
+
+	ls := s.logStore(logId)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.activate(ctx, logId); err != nil {
+		return nil, err
+	}
+	inBundle := make(map[uint32]bool, len(m.Massifs))
+	for _, e := range m.Massifs {
+		inBundle[e.MassifIndex] = true
+	}
+	// The checkpoints read so far, they are put once the massifs have been
+	checkpts := make(map[uint32]*massifs.Checkpoint)
+	checkptData := make(map[uint32][]byte)
+	checkedCheckpts := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+		mem, ok := pending[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not in the manifest", ErrInvalidBundle, hdr.Name)
+		}
+		delete(pending, hdr.Name)
+		if hdr.Size != mem.entry.Size {
+			return nil, fmt.Errorf("%w: %s is %d bytes, the manifest records %d", ErrInvalidBundle, hdr.Name, hdr.Size, mem.entry.Size)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read %s: %v", ErrInvalidBundle, hdr.Name, err)
+		}
+		if err := mem.entry.check(data); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, hdr.Name, err)
+		}
+
+		if mem.ty == storage.ObjectCheckpoint {
+			if checkedCheckpts {
+				return nil, fmt.Errorf("%w: checkpoint %s follows the massifs", ErrInvalidBundle, hdr.Name)
+			}
+			checkpt, err := ls.checkBundleCheckpoint(mem.entry.MassifIndex, data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, hdr.Name, err)
+			}
+			checkpts[mem.entry.MassifIndex], checkptData[mem.entry.MassifIndex] = checkpt, data
+			continue
+		}
+
+		if !checkedCheckpts {
+			if err := ls.checkImportCheckpoints(ctx, m.Checkpoints, checkpts, inBundle); err != nil {
+				return nil, err
+			}
+			checkedCheckpts = true
+		}
+		start, err := decodeStart(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, hdr.Name, err)
+		}
+		if start.MassifIndex != mem.entry.MassifIndex {
+			return nil, fmt.Errorf("%w: %s holds massif %d", ErrInvalidBundle, hdr.Name, start.MassifIndex)
+		}
+		if checkpt, ok := checkpts[start.MassifIndex]; ok {
+			if err := checkCheckpointExtent(checkpt, start, int64(len(data))); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, hdr.Name, err)
+			}
+		}
+		if err := ls.importObject(ctx, mem.entry.MassifIndex, mem.ty, data); err != nil {
+			return nil, err
+		}
+	}
+	if len(pending) != 0 {
+		missing := slices.Sorted(maps.Keys(pending))
+		return nil, fmt.Errorf("%w: %s are in the manifest but not the bundle", ErrInvalidBundle, strings.Join(missing, ", "))
+	}
+	if !checkedCheckpts {
+		if err := ls.checkImportCheckpoints(ctx, m.Checkpoints, checkpts, inBundle); err != nil {
+			return nil, err
+		}
+	}
+	for _, massifIndex := range slices.Sorted(maps.Keys(checkptData)) {
+		if err := ls.importObject(ctx, massifIndex, storage.ObjectCheckpoint, checkptData[massifIndex]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// checkBundleCheckpoint decodes a checkpoint from a bundle, and checks its
+// MMRSize is in the massif it is recorded for
+func (s *CachingStore) checkBundleCheckpoint(massifIndex uint32, data []byte) (*massifs.Checkpoint, error) {
+	checkpt, err := decodeCheckpoint(*s.Opts.StorageOptions.CBORCodec, data)
+	if err != nil {
+		return nil, err
+	}
+	mmrSize := checkpt.MMRState.MMRSize
+	if mmrSize == 0 {
+		return nil, fmt.Errorf("checkpoint mmr size is 0")
+	}
+	if found := uint32(massifs.MassifIndexFromMMRIndex(s.Opts.StorageOptions.MassifHeight, mmrSize-1)); found != massifIndex {
+		return nil, fmt.Errorf("%w: checkpoint mmr size %d is in massif %d", ErrIndexMismatch, mmrSize, found)
+	}
+	return checkpt, nil
+}
+
+// checkImportCheckpoints is called, once every checkpoint in the bundle has
+// been read, before the first massif is put. Checkpoints whose massif is not
+// in the bundle are checked against the massif in the log.
+func (s *CachingStore) checkImportCheckpoints(
+	ctx context.Context, entries []BundleEntry, checkpts map[uint32]*massifs.Checkpoint, inBundle map[uint32]bool) error {
+
+	for _, e := range entries {
+		checkpt, ok := checkpts[e.MassifIndex]
+		if !ok {
+			return fmt.Errorf("%w: checkpoint %s follows the massifs", ErrInvalidBundle, e.Name)
+		}
+		if inBundle[e.MassifIndex] {
+			continue
+		}
+		data, err := s.MassifReadN(ctx, e.MassifIndex, -1)
+		if errors.Is(err, storage.ErrDoesNotExist) {
+			return fmt.Errorf("%w: %s: massif %d not present", ErrInvalidBundle, e.Name, e.MassifIndex)
+		}
+		if err != nil {
+			return err
+		}
+		start, err := decodeStart(data)
+		if err != nil {
+			return err
+		}
+		if err := checkCheckpointExtent(checkpt, start, int64(len(data))); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidBundle, e.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkCheckpointExtent returns an error if the checkpoint's MMRSize
+// exceeds the massif data
+func checkCheckpointExtent(checkpt *massifs.Checkpoint, start *massifs.MassifStart, size int64) error {
+	logStart, detail := massifSizeDetail(start, size)
+	if detail != "" {
+		return errors.New(detail)
+	}
+	extent := start.FirstIndex + uint64(size-logStart)/massifs.ValueBytes
+	if mmrSize := checkpt.MMRState.MMRSize; mmrSize > extent {
+		return fmt.Errorf("checkpoint mmr size %d, massif %d data ends at %d", mmrSize, start.MassifIndex, extent)
+	}
+	return nil
+}
+
+// importObject puts an object from a bundle, unless the log already has it
+func (s *CachingStore) importObject(ctx context.Context, massifIndex uint32, ty storage.ObjectType, data []byte) error {
+	if paths, ok := s.Selected.MassifPaths[massifIndex]; ok {
+		if (ty == storage.ObjectMassifData && paths.Data != "") || (ty == storage.ObjectCheckpoint && paths.Checkpoint != "") {
+			existing, err := s.readObject(ctx, massifIndex, ty)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(existing, data) {
+				return fmt.Errorf("%w: %v for massif %d", ErrBundleConflict, ty, massifIndex)
+			}
+			return nil
+		}
+	}
+	return s.Put(ctx, massifIndex, ty, data, true)
+}
+
+// readObject reads a massif, or checkpoint, of the selected log in full
+func (s *CachingStore) readObject(ctx context.Context, massifIndex uint32, ty storage.ObjectType) ([]byte, error) {
+	if ty == storage.ObjectCheckpoint {
+		return s.CheckpointRead(ctx, massifIndex)
+	}
+	return s.MassifReadN(ctx, massifIndex, -1)
+}
+
+// bundleMemberName returns the name of the bundle member holding the object
+func bundleMemberName(logId storage.LogID, massifIndex uint32, ty storage.ObjectType) (string, error) {
+	dir := bundleMassifsDir
+	if ty == storage.ObjectCheckpoint {
+		dir = bundleCheckpointsDir
+	}
+	name, err := storage.ObjectPath(dir, logId, massifIndex, ty)
+	if err != nil {
+		return "", fmt.Errorf("failed to name massif %d, type %v in the bundle: %w", massifIndex, ty, err)
+	}
+	return name, nil
+}
+
+// add records an object in the manifest, extending the index ranges, and
+// returns the name of its member
+func (m *BundleManifest) add(logId storage.LogID, massifIndex uint32, ty storage.ObjectType, data []byte) (string, error) {
+	entries, first, head := &m.Massifs, &m.FirstMassif, &m.HeadMassif
+	if ty == storage.ObjectCheckpoint {
+		entries, first, head = &m.Checkpoints, &m.FirstSeal, &m.HeadSeal
+	}
+	name, err := bundleMemberName(logId, massifIndex, ty)
+	if err != nil {
+		return "", err
+	}
+	if len(*entries) == 0 || massifIndex < *first {
+		*first = massifIndex
+	}
+	if massifIndex > *head {
+		*head = massifIndex
+	}
+	sum := sha256.Sum256(data)
+	*entries = append(*entries, BundleEntry{
+		MassifIndex: massifIndex,
+		Name:        name,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	})
+	return name, nil
+}
+
+// check returns an error if the data does not match the size and digest of the entry
+func (e BundleEntry) check(data []byte) error {
+	if int64(len(data)) != e.Size {
+		return fmt.Errorf("%d bytes, expected %d", len(data), e.Size)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != e.SHA256 {
+		return fmt.Errorf("sha256 %x, expected %s", sum, e.SHA256)
+	}
+	return nil
+}
+
+func writeBundleMember(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s to the bundle: %w", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s to the bundle: %w", name, err)
+	}
+	return nil
+}
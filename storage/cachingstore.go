@@ -2,9 +2,12 @@ package storage
 
 import (
 	"bytes"
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/forestrie/go-merklelog/massifs"
 	commoncbor "github.com/forestrie/go-merklelog/massifs/cbor"
@@ -12,10 +15,52 @@ import (
 )
 
 type CachingStore struct {
+	// mu serializes SelectLog, EvictLog and Close with each other. For the
+	// per log stores behind LogHandles, it is the lock for the log, held for
+	// each call through a handle.
+	mu sync.Mutex
+
 	Opts          Options
 	SelectedLogID storage.LogID
 	Logs          map[string]*LogCache
 	Selected      *LogCache
+
+	// read only mappings of sealed massifs, keyed by path
+	mappings map[string]*mapping
+
+	// shared is the state shared with the per log stores behind LogHandles
+	shared *sharedState
+
+	// ownsArchive is set if the store opened Opts.Archive, and so must close it
+	ownsArchive bool
+}
+
+// sharedState is shared by a store and the per log stores behind its
+// handles. Its lock is only held briefly, never while waiting for a writer
+// lock or for the lock of a log.
+type sharedState struct {
+	mu sync.Mutex
+
+	// logStores are the per log stores behind handles, keyed by log id
+	logStores map[string]*CachingStore
+
+	// writer locks held, keyed by log id
+	locks map[string]*os.File
+
+	// least recently used order of the cached objects, across all logs and stores
+	lru         *list.List
+	lruIndex    map[cacheKey]*list.Element
+	cachedBytes int64
+	// pending are entries evicted while the store caching them was busy. The
+	// store drops them when it is next activated.
+	pending map[*CachingStore][]*cacheEntry
+
+	// listings are the sorted log directory names found by ListLogs, keyed by logs directory
+	listings map[string]*logsListing
+
+	// opts are the options of the store, before its openers are bound to a
+	// log, for the per log stores
+	opts Options
 }
 
 func (s *CachingStore) Init(ctx context.Context, parent *Options, vopts ...massifs.Option) error {
@@ -28,29 +73,46 @@ func (s *CachingStore) Init(ctx context.Context, parent *Options, vopts ...massi
 	if err = s.Opts.FillDefaults(); err != nil {
 		return err
 	}
+	if err = s.openArchive(); err != nil {
+		return err
+	}
+	s.openEncryption()
 
 	s.Logs = make(map[string]*LogCache)
+	s.shared = &sharedState{opts: s.Opts}
 
 	err = s.checkOptions()
 	if err != nil {
 		return err
 	}
 
-	if s.Opts.CreateRootDir && s.Opts.RootDir != "" {
+	if s.Opts.CreateRootDir && s.Opts.RootDir != "" && s.Opts.Archive == nil {
 		if err := os.MkdirAll(s.Opts.RootDir, s.Opts.DirCreateMode); err != nil {
 			return fmt.Errorf("failed to create root dir %s: %w", s.Opts.RootDir, err)
 		}
 	}
 
 	if s.Opts.LogID != nil {
-		if err := s.SelectLog(ctx, s.Opts.LogID); err != nil {
+		if err := s.selectLog(ctx, s.Opts.LogID); err != nil {
 			return fmt.Errorf("failed to select log %s: %w", s.Opts.LogID, err)
 		}
 	}
 	return nil
 }
 
+// SelectLog makes the log the target of the store's reader and writer
+// methods, populating its cache if it is not already selected.
+//
+// Selection is shared by every caller of the store. Use Log to obtain a
+// handle when working with several logs from different goroutines.
 func (s *CachingStore) SelectLog(ctx context.Context, logId storage.LogID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropPending()
+	return s.selectLog(ctx, logId)
+}
+
+func (s *CachingStore) selectLog(ctx context.Context, logId storage.LogID) error {
 	if s.Logs == nil {
 		return fmt.Errorf("massif cache not initialized")
 	}
@@ -62,9 +124,21 @@ func (s *CachingStore) SelectLog(ctx context.Context, logId storage.LogID) error
 		return nil // Already selected
 	}
 
-	s.SelectedLogID = logId
+	// The lock is taken before the log is selected, so that a log which can
+	// not be locked is never left selected for Put to write to unlocked.
+	s.SelectedLogID, s.Selected = logId, nil
+	s.bindEncryption(logId)
+	if err := s.lockForWrite(ctx, WriterLockOnSelect); err != nil {
+		s.SelectedLogID = nil
+		return err
+	}
 
-	return s.PopulateCache(ctx)
+	err := s.PopulateCache(ctx)
+	if errors.Is(err, ErrUnhealthy) {
+		// Leave nothing selected, so that the log can not be used
+		s.SelectedLogID, s.Selected = nil, nil
+	}
+	return err
 }
 
 func (s *CachingStore) checkOptions() error {
@@ -78,7 +152,7 @@ func (s *CachingStore) checkOptions() error {
 		return fmt.Errorf("a ReadOpener must be provided")
 	}
 
-	if s.Opts.RootDir != "" {
+	if s.Opts.RootDir != "" && s.Opts.Archive == nil {
 		if !s.Opts.CreateRootDir {
 			if stat, err := os.Stat(s.Opts.RootDir); err != nil || !stat.IsDir() {
 				return fmt.Errorf("root dir %s is not a directory or cannot be accessed: %w", s.Opts.RootDir, err)
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	// ChecksumExt is appended to the name of an object to name its checksum sidecar
+	ChecksumExt = ".sha256"
+)
+
+var (
+	ErrCorrupt = errors.New("object content does not match its checksum")
+)
+
+// ChecksumError is returned when the content of an object does not match the
+// digest recorded in its checksum sidecar.
+type ChecksumError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: %s has sha256 %s, expected %s", ErrCorrupt, e.Path, e.Actual, e.Expected)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// ChecksumSidecar is the content of the checksum sidecar of an object
+type ChecksumSidecar struct {
+	MassifIndex uint32 `json:"massifIndex"`
+	// Name is the file name of the object
+	Name string `json:"name"`
+	// Size and SHA256 are of the object content, before any compression or encryption
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// CachedChecksum is the checksum sidecar of an object, as read for a
+// version of the object
+type CachedChecksum struct {
+	Version VersionToken
+	// Sidecar is nil if the object has none
+	Sidecar *ChecksumSidecar
+}
+
+// ChecksumPath returns the path of the checksum sidecar for the object. A
+// massif and its compressed form share a sidecar, as the digest is of the
+// uncompressed content.
+func ChecksumPath(storagePath string) string {
+	return strings.TrimSuffix(storagePath, CompressedExt) + ChecksumExt
+}
+
+// writeChecksum records the digest of an object just written by Put, if Checksums is set
+func (s *CachingStore) writeChecksum(massifIndex uint32, storagePath string, data []byte) error {
+	if !s.Opts.Checksums {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	sidecar, err := json.Marshal(ChecksumSidecar{
+		MassifIndex: massifIndex,
+		Name:        filepath.Base(storagePath),
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return err
+	}
+	s.forgetChecksum(storagePath)
+	return s.writeAtomic(ChecksumPath(storagePath), sidecar, false)
+}
+
+// removeChecksum removes the checksum sidecar of an object Put is about to
+// replace, whether or not Checksums is set, so that an interrupted Put, or
+// one by a store without Checksums, never leaves a sidecar describing
+// content the object no longer has. The object is then unchecked until
+// writeChecksum records its new digest.
+func (s *CachingStore) removeChecksum(storagePath string) error {
+	s.forgetChecksum(storagePath)
+	sidecarPath := ChecksumPath(storagePath)
+	err := os.Remove(sidecarPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove checksum %s: %w", sidecarPath, err)
+	}
+	// The removal must be durable before the object is replaced
+	if err := syncDir(filepath.Dir(sidecarPath)); err != nil {
+		return fmt.Errorf("failed to sync directory for %s: %w", sidecarPath, err)
+	}
+	return nil
+}
+
+// readChecksum returns the checksum sidecar of the object, or false if it has none
+func (s *CachingStore) readChecksum(storagePath string) (ChecksumSidecar, bool, error) {
+	sidecarPath := ChecksumPath(storagePath)
+	f, err := s.Opts.ReadOpener.Open(sidecarPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ChecksumSidecar{}, false, nil
+		}
+		return ChecksumSidecar{}, false, fmt.Errorf("failed to open checksum %s: %w", sidecarPath, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return ChecksumSidecar{}, false, fmt.Errorf("failed to read checksum %s: %w", sidecarPath, err)
+	}
+	var e ChecksumSidecar
+	if err := json.Unmarshal(data, &e); err != nil {
+		return ChecksumSidecar{}, false, fmt.Errorf("failed to decode checksum %s: %w", sidecarPath, err)
+	}
+	return e, true, nil
+}
+
+// verifyChecksum checks data read from the object against its checksum
+// sidecar, if Checksums is set. If complete is set, the data is the whole
+// object, and a size differing from the sidecar is corruption. Partial reads
+// are only checked if they happen to cover the whole object. Objects without
+// a sidecar, such as those written before Checksums was set, are not
+// checked.
+func (s *CachingStore) verifyChecksum(storagePath string, data []byte, complete bool) error {
+	if !s.Opts.Checksums {
+		return nil
+	}
+	e, ok, err := s.readChecksum(storagePath)
+	if err != nil || !ok {
+		return err
+	}
+	return checkDigest(storagePath, e, data, complete)
+}
+
+// verifyPartialChecksum is verifyChecksum for partial reads, which are
+// repeated as a massif is read at growing sizes. The sidecar is cached for
+// the version of the object described by info, and only read again once the
+// object changes. Objects modified within the modification time granularity
+// are not cached, as a further change may leave their version the same.
+func (s *CachingStore) verifyPartialChecksum(storagePath string, info fs.FileInfo, data []byte) error {
+	if !s.Opts.Checksums {
+		return nil
+	}
+	if s.Selected == nil || info == nil || time.Since(info.ModTime()) < mtimeGranularity(info.ModTime()) {
+		return s.verifyChecksum(storagePath, data, false)
+	}
+	v := VersionToken{Size: info.Size(), ModTime: info.ModTime()}
+	c, ok := s.Selected.Checksums[storagePath]
+	if !ok || !c.Version.Matches(v) {
+		e, found, err := s.readChecksum(storagePath)
+		if err != nil {
+			return err
+		}
+		c = CachedChecksum{Version: v}
+		if found {
+			c.Sidecar = &e
+		}
+		s.Selected.Checksums[storagePath] = c
+	}
+	if c.Sidecar == nil {
+		return nil
+	}
+	return checkDigest(storagePath, *c.Sidecar, data, false)
+}
+
+// forgetChecksum drops the cached sidecar of an object whose sidecar is
+// about to change
+func (s *CachingStore) forgetChecksum(storagePath string) {
+	if s.Selected != nil {
+		delete(s.Selected.Checksums, storagePath)
+	}
+}
+
+// checkDigest checks data read from the object against its sidecar, see verifyChecksum
+func checkDigest(storagePath string, e ChecksumSidecar, data []byte, complete bool) error {
+	if !complete && int64(len(data)) != e.Size {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != e.SHA256 {
+		return &ChecksumError{Path: storagePath, Expected: e.SHA256, Actual: actual}
+	}
+	return nil
+}
+
+type ScrubResult struct {
+	// Checked is the number of objects whose content was checked
+	Checked int
+	// Unchecked are the paths of objects without a checksum sidecar
+	Unchecked []string
+	// Corrupt lists the objects whose content does not match their checksum
+	Corrupt []*ChecksumError
+}
+
+// Scrub re-reads every massif and checkpoint of the log from disk, and
+// checks it against its checksum sidecar. Corrupt objects are reported in
+// the result, the error is for failures to read.
+//
+// The lock for the log is held only to list the objects, which are then
+// read without the cache, so Scrub may run in the background alongside
+// handles for the same, or other, logs. Objects removed while the scrub runs, for
+// example by compression, are skipped.
+func (s *CachingStore) Scrub(ctx context.Context, logId storage.LogID) (ScrubResult, error) {
+	ls := s.logStore(logId)
+	ls.mu.Lock()
+	if err := ls.activate(ctx, logId); err != nil {
+		ls.mu.Unlock()
+		return ScrubResult{}, err
+	}
+	var storagePaths []string
+	for _, massifIndex := range slices.Sorted(maps.Keys(ls.Selected.MassifPaths)) {
+		paths := ls.Selected.MassifPaths[massifIndex]
+		for _, storagePath := range []string{paths.Data, paths.Checkpoint} {
+			if storagePath != "" {
+				storagePaths = append(storagePaths, storagePath)
+			}
+		}
+	}
+	ls.mu.Unlock()
+
+	// The objects are read through ls, as its openers stay bound to the log
+	var result ScrubResult
+	for _, storagePath := range storagePaths {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		e, ok, err := ls.readChecksum(storagePath)
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			result.Unchecked = append(result.Unchecked, storagePath)
+			continue
+		}
+		actual, err := ls.hashObject(storagePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Checked++
+		if actual != e.SHA256 {
+			result.Corrupt = append(result.Corrupt, &ChecksumError{Path: storagePath, Expected: e.SHA256, Actual: actual})
+		}
+	}
+	return result, nil
+}
+
+// hashObject returns the hex encoded SHA-256 digest of the object content.
+// It does not modify the store, and is safe to call concurrently.
+func (s *CachingStore) hashObject(storagePath string) (string, error) {
+	f, err := s.openObject(storagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", storagePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	// CompressedExt is appended to the name of a sealed massif when it is compressed
+	CompressedExt = ".gz"
+)
+
+// IsCompressed returns true if the object at storagePath is gzip compressed
+func IsCompressed(storagePath string) bool {
+	return strings.HasSuffix(storagePath, CompressedExt)
+}
+
+// hasObjectExt returns true if the name ends with the extension, or the extension of its compressed form
+func hasObjectExt(name string, ext string) bool {
+	return strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+CompressedExt)
+}
+
+// gzipReadCloser decompresses an opened object, closing the underlying object when it is closed
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	return errors.Join(r.Reader.Close(), r.file.Close())
+}
+
+// Stat returns the FileInfo of the compressed file, if the opener provides it
+func (r *gzipReadCloser) Stat() (fs.FileInfo, error) {
+	if info := fileInfo(r.file); info != nil {
+		return info, nil
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// openObject opens the object through the ReadOpener, decompressing it if it is compressed
+func (s *CachingStore) openObject(storagePath string) (io.ReadCloser, error) {
+	f, err := s.Opts.ReadOpener.Open(storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if !IsCompressed(storagePath) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", storagePath, err)
+	}
+	return &gzipReadCloser{Reader: zr, file: f}, nil
+}
+
+// objectSize returns the size of the object content. For compressed objects
+// this is the decompressed size, as recorded in the gzip trailer. If the
+// files are not read directly, the content is read through the ReadOpener
+// to find its size, unless the opener can report it more cheaply.
+func (s *CachingStore) objectSize(storagePath string) (int64, error) {
+	if !s.plainFiles() {
+		if cs, ok := s.Opts.ReadOpener.(contentSizer); ok && !IsCompressed(storagePath) {
+			return cs.ContentSize(storagePath)
+		}
+		f, err := s.openObject(storagePath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return io.Copy(io.Discard, f)
+	}
+	info, err := os.Stat(storagePath)
+	if err != nil {
+		return 0, err
+	}
+	if !IsCompressed(storagePath) {
+		return info.Size(), nil
+	}
+	if info.Size() < 4 {
+		return 0, fmt.Errorf("compressed file %s is too small", storagePath)
+	}
+	f, err := os.Open(storagePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var trailer [4]byte
+	if _, err := f.ReadAt(trailer[:], info.Size()-4); err != nil {
+		return 0, fmt.Errorf("failed to read the size of %s: %w", storagePath, err)
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+// CompressSealedMassifs compresses every sealed massif of the selected log
+// which is not already compressed, returning their indices. A massif is
+// sealed once it has a checkpoint and the log has moved on to a later
+// massif.
+func (s *CachingStore) CompressSealedMassifs(ctx context.Context) ([]uint32, error) {
+	if s.Selected == nil {
+		return nil, storage.ErrLogNotSelected
+	}
+	if s.Opts.Archive != nil {
+		return nil, ErrReadOnly
+	}
+	var compressed []uint32
+	for massifIndex, paths := range s.Selected.MassifPaths {
+		if err := ctx.Err(); err != nil {
+			return compressed, err
+		}
+		if IsCompressed(paths.Data) || !s.isSealed(massifIndex) {
+			continue
+		}
+		if err := s.compressMassif(massifIndex); err != nil {
+			return compressed, err
+		}
+		compressed = append(compressed, massifIndex)
+	}
+	return compressed, nil
+}
+
+// compressIfSealed compresses the massifs which the object just written may
+// have sealed, if CompressSealed is set. A new massif seals its predecessor,
+// and a checkpoint may seal its own massif.
+//
+// A checkpoint alone does not seal the head massif. Checkpoints are written
+// for the head massif as leaves are added, and the massif is appended to
+// until it is full, so it is only compressed once the log moves on to the
+// next massif. Compressing it earlier would force each later append to
+// rewrite the whole massif.
+func (s *CachingStore) compressIfSealed(massifIndex uint32, ty storage.ObjectType) error {
+	if !s.Opts.CompressSealed {
+		return nil
+	}
+	if ty != storage.ObjectCheckpoint {
+		if massifIndex == 0 {
+			return nil
+		}
+		massifIndex--
+	}
+	paths, ok := s.Selected.MassifPaths[massifIndex]
+	if !ok || IsCompressed(paths.Data) || !s.isSealed(massifIndex) {
+		return nil
+	}
+	return s.compressMassif(massifIndex)
+}
+
+// compressMassif replaces the massif file with its compressed sibling
+func (s *CachingStore) compressMassif(massifIndex uint32) error {
+	paths := s.Selected.MassifPaths[massifIndex]
+	plain := paths.Data
+
+	data, _, err := s.readFile(plain)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", plain, err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", plain, err)
+	}
+
+	manifestCurrent, err := s.manifestCurrent()
+	if err != nil {
+		return err
+	}
+	compressed := plain + CompressedExt
+	if err := s.writeAtomic(compressed, buf.Bytes(), false); err != nil {
+		return err
+	}
+	// Until the plain file is removed, listings prefer it to the compressed sibling
+	if err := os.Remove(plain); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s after compressing it: %w", plain, err)
+	}
+	if err := s.relocateMassif(massifIndex, plain, compressed); err != nil {
+		return err
+	}
+	if err := s.recordWrittenVersion(compressed, data); err != nil {
+		return err
+	}
+	return s.updateManifest(massifIndex, storage.ObjectMassifData, compressed, data, manifestCurrent)
+}
+
+// relocateMassif points the selected log cache at the compressed sibling of
+// a massif. Cached data for the old path is dropped, and re-read from the
+// new path on the next access.
+func (s *CachingStore) relocateMassif(massifIndex uint32, from, to string) error {
+	if data, ok := s.Selected.MassifData[from]; ok {
+		s.Selected.Evicted[to] = len(data)
+	} else if n, ok := s.Selected.Evicted[from]; ok {
+		s.Selected.Evicted[to] = n
+	}
+	if s.Selected.Unverified[from] {
+		s.Selected.Unverified[to] = true
+	}
+	s.cacheDrop(from, cachedMassif)
+	s.cacheDropRanges(from)
+	if err := s.unmapMassif(from); err != nil {
+		return fmt.Errorf("failed to release mapping of %s: %w", from, err)
+	}
+	delete(s.Selected.Evicted, from)
+	delete(s.Selected.Unverified, from)
+	delete(s.Selected.Versions, from)
+
+	if paths, ok := s.Selected.MassifPaths[massifIndex]; ok && paths.Data == from {
+		paths.Data = to
+	}
+	return nil
+}
+
+// forgetRemoved updates the selected log cache for a massif or checkpoint
+// file which no longer exists. If another writer compressed the massif, the
+// cache is pointed at the compressed sibling, and true is returned.
+// Otherwise the file is forgotten, so that later reads report the object as
+// missing.
+func (s *CachingStore) forgetRemoved(storagePath string) (bool, error) {
+	for massifIndex, paths := range s.Selected.MassifPaths {
+		if paths.Data != storagePath || IsCompressed(storagePath) {
+			continue
+		}
+		if _, err := os.Stat(storagePath + CompressedExt); err == nil {
+			return true, s.relocateMassif(massifIndex, storagePath, storagePath+CompressedExt)
+		}
+	}
+	s.cacheDrop(storagePath, cachedMassif)
+	s.cacheDropRanges(storagePath)
+	s.cacheDrop(storagePath, cachedCheckpoint)
+	if err := s.unmapMassif(storagePath); err != nil {
+		return false, err
+	}
+	delete(s.Selected.Versions, storagePath)
+	delete(s.Selected.Evicted, storagePath)
+	delete(s.Selected.Unverified, storagePath)
+	s.removePath(storagePath)
+	return false, nil
+}
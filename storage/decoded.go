@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/forestrie/go-merklelog/massifs"
+)
+
+// MassifStart returns the decoded start header of the massif. The decoded
+// header is cached until the massif data is replaced, so callers must not
+// modify it. If StaleCheckInterval is set, the cached header is only used
+// once the file has been checked for changes, as MassifData does.
+func (s *CachingStore) MassifStart(ctx context.Context, massifIndex uint32) (*massifs.MassifStart, error) {
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, err
+	}
+	storagePath, ok, err := s.dataPath(massifIndex)
+	if err == nil && ok {
+		if err := s.refreshFileIfStale(storagePath); err != nil {
+			return nil, err
+		}
+		if start, ok := s.Selected.Starts[storagePath]; ok {
+			return start, nil
+		}
+		// Decoded in place, as the whole of a mapped massif would be copied
+		// by MassifData
+		if data, ok := s.Selected.MassifData[storagePath]; ok && len(data) >= massifs.StartHeaderSize && !s.Selected.Unverified[storagePath] {
+			start, err := decodeStart(data)
+			if err != nil {
+				return nil, err
+			}
+			s.cacheTouch(storagePath, cachedMassif)
+			s.Selected.Starts[storagePath] = start
+			return start, nil
+		}
+	}
+
+	data, ok, err := s.MassifData(massifIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || len(data) < massifs.StartHeaderSize {
+		if data, err = s.MassifReadN(ctx, massifIndex, massifs.StartHeaderSize); err != nil {
+			return nil, err
+		}
+	}
+	start, err := decodeStart(data)
+	if err != nil {
+		return nil, err
+	}
+	// MassifData or MassifReadN have established the path
+	storagePath, _, _ = s.dataPath(massifIndex)
+	s.Selected.Starts[storagePath] = start
+	return start, nil
+}
+
+// Checkpoint returns the decoded checkpoint for the massif. The decoded
+// checkpoint is cached until the checkpoint data is replaced, so callers must
+// not modify it. If StaleCheckInterval is set, the cached checkpoint is only
+// used once the file has been checked for changes, as CheckpointData does.
+func (s *CachingStore) Checkpoint(ctx context.Context, massifIndex uint32) (*massifs.Checkpoint, error) {
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, err
+	}
+	storagePath, ok, err := s.checkpointPath(massifIndex)
+	if err == nil && ok {
+		if err := s.refreshFileIfStale(storagePath); err != nil {
+			return nil, err
+		}
+		if checkpt, ok := s.Selected.Checkpoints[storagePath]; ok {
+			return checkpt, nil
+		}
+	}
+
+	data, ok, err := s.CheckpointData(massifIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if data, err = s.CheckpointRead(ctx, massifIndex); err != nil {
+			return nil, err
+		}
+	}
+	checkpt, err := decodeCheckpoint(*s.Opts.StorageOptions.CBORCodec, data)
+	if err != nil {
+		return nil, err
+	}
+	storagePath, _, _ = s.checkpointPath(massifIndex)
+	s.Selected.Checkpoints[storagePath] = checkpt
+	return checkpt, nil
+}
+
+func (h *LogHandle) MassifStart(ctx context.Context, massifIndex uint32) (*massifs.MassifStart, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.MassifStart(ctx, massifIndex)
+}
+
+func (h *LogHandle) Checkpoint(ctx context.Context, massifIndex uint32) (*massifs.Checkpoint, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.Checkpoint(ctx, massifIndex)
+}
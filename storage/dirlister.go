@@ -4,6 +4,8 @@ import "strings"
 
 type SuffixDirLister struct {
 	OsDirLister
+	// Lister, if set, is used in place of the OsDirLister
+	Lister DirLister
 	Suffix string
 }
 
@@ -11,16 +13,36 @@ func NewSuffixDirLister(suffix string) DirLister {
 	return &SuffixDirLister{Suffix: suffix}
 }
 
+// NewSuffixDirListerWith filters the files listed by lister
+func NewSuffixDirListerWith(lister DirLister, suffix string) DirLister {
+	return &SuffixDirLister{Lister: lister, Suffix: suffix}
+}
+
+// ListFiles returns the files with the suffix, including compressed files
+// whose names end with the suffix followed by CompressedExt. If both a file
+// and its compressed sibling exist, only the uncompressed file is returned.
 func (s *SuffixDirLister) ListFiles(name string) ([]string, error) {
-	found, err := s.OsDirLister.ListFiles(name)
+	var lister DirLister = &s.OsDirLister
+	if s.Lister != nil {
+		lister = s.Lister
+	}
+	found, err := lister.ListFiles(name)
 	if err != nil {
 		return nil, err
 	}
+	listed := make(map[string]bool, len(found))
+	for _, f := range found {
+		listed[f] = true
+	}
 	var matched []string
 	for _, f := range found {
-		if strings.HasSuffix(f, s.Suffix) {
-			matched = append(matched, f)
+		if !hasObjectExt(f, s.Suffix) {
+			continue
+		}
+		if IsCompressed(f) && listed[strings.TrimSuffix(f, CompressedExt)] {
+			continue
 		}
+		matched = append(matched, f)
 	}
 	return matched, nil
 }
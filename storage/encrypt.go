@@ -0,0 +1,648 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	// DefaultEncryptionChunkSize is the amount of content sealed in each chunk of an encrypted file
+	DefaultEncryptionChunkSize = 64 * 1024
+
+	encryptedMagic      = "MLFSENC1"
+	encryptedSaltSize   = 32
+	encryptedHeaderSize = len(encryptedMagic) + 4 + encryptedSaltSize
+	dataKeyInfo         = "go-merklelog-fs data key"
+	fileKeyInfo         = "go-merklelog-fs file key"
+)
+
+var (
+	ErrDecrypt = errors.New("object could not be decrypted")
+)
+
+// KeyProvider supplies the data key for each log. Keys must be 16, 24 or 32
+// bytes, selecting AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	DataKey(logID storage.LogID) ([]byte, error)
+}
+
+// KeyFileProvider derives the data key for each log from a master key held
+// in a local file. The file holds the 32 byte master key, hex encoded.
+type KeyFileProvider struct {
+	masterKey []byte
+}
+
+// NewKeyFileProvider reads the master key from the key file
+func NewKeyFileProvider(keyFile string) (*KeyFileProvider, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %w", keyFile, err)
+	}
+	masterKey, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(masterKey) != 32 {
+		return nil, fmt.Errorf("key file %s does not hold a hex encoded 32 byte key", keyFile)
+	}
+	return &KeyFileProvider{masterKey: masterKey}, nil
+}
+
+// GenerateKeyFile writes a new random master key to the key file, which must not already exist
+func GenerateKeyFile(keyFile string) error {
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(keyFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return writeAndSync(f, []byte(hex.EncodeToString(masterKey)+"\n"))
+}
+
+// DataKey derives the AES-256 key for the log from the master key
+func (p *KeyFileProvider) DataKey(logID storage.LogID) ([]byte, error) {
+	return hkdf.Key(sha256.New, p.masterKey, nil, dataKeyInfo+" "+hex.EncodeToString(logID), 32)
+}
+
+// logCiphers caches the data key for each log
+type logCiphers struct {
+	keys KeyProvider
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// fileKey returns the data key for the log holding the object, and the name
+// the object's content is bound to. The name is the hex encoded log id and
+// the file name, so it is the same for every directory layout, and for the
+// temporary file an object is written through. The log is the one the
+// opener is bound to, never one named in the path, which may be anything
+// above the root dir, or a file outside any layout.
+func (c *logCiphers) fileKey(logID storage.LogID, storagePath string) ([]byte, string, error) {
+	if logID == nil {
+		return nil, "", fmt.Errorf("no log is selected for %s, the encrypting opener must be bound to one", storagePath)
+	}
+	name := hex.EncodeToString(logID) + "/" + filepath.Base(targetPath(storagePath))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.data[string(logID)]; ok {
+		return key, name, nil
+	}
+	key, err := c.keys.DataKey(logID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get the data key for %s: %w", storagePath, err)
+	}
+	if c.data == nil {
+		c.data = make(map[string][]byte)
+	}
+	c.data[string(logID)] = key
+	return key, name, nil
+}
+
+// chunkCipher seals and opens the chunks of one encrypted file.
+//
+// An encrypted file is a header, holding a magic string, the chunk size and
+// a random salt, followed by the content in chunks of the chunk size, each
+// sealed with AES-GCM. The key for the file is derived from the log's data
+// key and the salt, so nonces never repeat across files, and a chunk's nonce
+// is simply its index. The last chunk may be shorter, and is marked as last
+// in its additional data, so truncating a file at a chunk boundary is
+// detected. Empty content is a single, empty, last chunk.
+//
+// The additional data also binds the header, and the name of the object, so
+// a file moved or copied to another object's name fails to decrypt.
+//
+// Each chunk can be opened independently, so reading the start header of a
+// massif, or a range of it, decrypts only the chunks covering it.
+type chunkCipher struct {
+	aead      cipher.AEAD
+	header    []byte
+	name      string
+	chunkSize int
+}
+
+func newChunkCipher(dataKey []byte, name string, chunkSize int) (*chunkCipher, error) {
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic)
+	binary.BigEndian.PutUint32(header[len(encryptedMagic):], uint32(chunkSize))
+	if _, err := rand.Read(header[len(encryptedMagic)+4:]); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(dataKey, header)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead, header: header, name: name, chunkSize: chunkSize}, nil
+}
+
+// parseChunkCipher reads the header of an encrypted file
+func parseChunkCipher(dataKey []byte, name string, header []byte) (*chunkCipher, error) {
+	if len(header) != encryptedHeaderSize || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrDecrypt)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(encryptedMagic):]))
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("%w: invalid chunk size", ErrDecrypt)
+	}
+	aead, err := fileAEAD(dataKey, header)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead, header: bytes.Clone(header), name: name, chunkSize: chunkSize}, nil
+}
+
+// fileAEAD derives the key for a file from the data key and the salt in its header
+func fileAEAD(dataKey, header []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, dataKey, header[len(encryptedMagic)+4:], fileKeyInfo, len(dataKey))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *chunkCipher) nonceAndData(index uint32, last bool) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], index)
+	additional := make([]byte, 0, len(c.header)+len(c.name)+1)
+	additional = append(additional, c.header...)
+	additional = append(additional, c.name...)
+	additional = append(additional, 0)
+	if last {
+		additional[len(additional)-1] = 1
+	}
+	return nonce, additional
+}
+
+func (c *chunkCipher) seal(index uint32, last bool, plaintext []byte) []byte {
+	nonce, additional := c.nonceAndData(index, last)
+	return c.aead.Seal(nil, nonce, plaintext, additional)
+}
+
+func (c *chunkCipher) open(index uint32, last bool, sealed []byte) ([]byte, error) {
+	nonce, additional := c.nonceAndData(index, last)
+	plaintext, err := c.aead.Open(nil, nonce, sealed, additional)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d failed authentication", ErrDecrypt, index)
+	}
+	return plaintext, nil
+}
+
+// sealedChunkSize is the size of a full chunk on disk
+func (c *chunkCipher) sealedChunkSize() int64 {
+	return int64(c.chunkSize + c.aead.Overhead())
+}
+
+// chunkCount returns the number of chunks in an encrypted file of the size
+func (c *chunkCipher) chunkCount(fileSize int64) (int64, error) {
+	body := fileSize - int64(encryptedHeaderSize)
+	if body < int64(c.aead.Overhead()) {
+		return 0, fmt.Errorf("%w: the file is truncated", ErrDecrypt)
+	}
+	return (body + c.sealedChunkSize() - 1) / c.sealedChunkSize(), nil
+}
+
+// contentSize returns the size of the content of an encrypted file of the size
+func (c *chunkCipher) contentSize(fileSize int64) (int64, error) {
+	n, err := c.chunkCount(fileSize)
+	if err != nil {
+		return 0, err
+	}
+	size := fileSize - int64(encryptedHeaderSize) - n*int64(c.aead.Overhead())
+	if size < 0 || (n > 1 && size <= (n-1)*int64(c.chunkSize)) {
+		return 0, fmt.Errorf("%w: the file is truncated", ErrDecrypt)
+	}
+	return size, nil
+}
+
+// EncryptingOpener decrypts the files opened by the wrapped Opener, with
+// the data key of the log it is bound to by ForLog. The store binds its
+// openers to each log it selects, so every file it opens is decrypted as
+// part of the selected log, whatever the layout, or path, of the file.
+//
+// It implements ReaderAtOpener, decrypting only the chunks covering each
+// read. If the wrapped Opener does not support random access reads, the
+// whole file is decrypted into memory when it is opened.
+type EncryptingOpener struct {
+	Inner   Opener
+	ciphers *logCiphers
+	logID   storage.LogID
+}
+
+// EncryptingWriteOpener encrypts the files written through the wrapped
+// WriteOpener. It does not support appending, so every Put replaces the
+// whole object.
+//
+// As for EncryptingOpener, files are encrypted with the data key of the log
+// it is bound to by ForLog. Writers finish the content when they are
+// synced, or closed, so nothing may be written after Sync.
+type EncryptingWriteOpener struct {
+	Inner     WriteOpener
+	ChunkSize int
+	ciphers   *logCiphers
+	logID     storage.LogID
+}
+
+func NewEncryptingOpener(inner Opener, keys KeyProvider) *EncryptingOpener {
+	return &EncryptingOpener{Inner: inner, ciphers: &logCiphers{keys: keys}}
+}
+
+func NewEncryptingWriteOpener(inner WriteOpener, keys KeyProvider) *EncryptingWriteOpener {
+	return &EncryptingWriteOpener{Inner: inner, ChunkSize: DefaultEncryptionChunkSize, ciphers: &logCiphers{keys: keys}}
+}
+
+// ForLog returns an opener for the files of the log, sharing the cached data keys
+func (o *EncryptingOpener) ForLog(logID storage.LogID) *EncryptingOpener {
+	return &EncryptingOpener{Inner: o.Inner, ciphers: o.ciphers, logID: logID}
+}
+
+// ForLog returns a write opener for the files of the log, sharing the cached data keys
+func (o *EncryptingWriteOpener) ForLog(logID storage.LogID) *EncryptingWriteOpener {
+	return &EncryptingWriteOpener{Inner: o.Inner, ChunkSize: o.ChunkSize, ciphers: o.ciphers, logID: logID}
+}
+
+// openCipher opens the file and reads its header
+func (o *EncryptingOpener) openCipher(name string) (io.ReadCloser, *bufio.Reader, *chunkCipher, error) {
+	key, objectName, err := o.ciphers.fileKey(o.logID, name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := o.Inner.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%w: failed to read the header of %s: %v", ErrDecrypt, name, err)
+	}
+	c, err := parseChunkCipher(key, objectName, header)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return f, br, c, nil
+}
+
+// Open opens the named file for sequential reads of its decrypted content
+func (o *EncryptingOpener) Open(name string) (io.ReadCloser, error) {
+	f, br, c, err := o.openCipher(name)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{file: f, r: br, c: c, name: name}, nil
+}
+
+// OpenReaderAt opens the named file for random access reads of its decrypted content
+func (o *EncryptingOpener) OpenReaderAt(name string) (ReaderAtCloser, error) {
+	ro, ok := o.Inner.(ReaderAtOpener)
+	if !ok {
+		rc, err := o.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveReader{Reader: bytes.NewReader(data), ReaderAt: bytes.NewReader(data), info: fileInfo(rc)}, nil
+	}
+
+	key, objectName, err := o.ciphers.fileKey(o.logID, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ro.OpenReaderAt(name)
+	if err != nil {
+		return nil, err
+	}
+	info := statReaderAt(f)
+	if info == nil {
+		f.Close()
+		return nil, fmt.Errorf("the size of %s is not available: %w", name, errors.ErrUnsupported)
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: failed to read the header of %s: %v", ErrDecrypt, name, err)
+	}
+	c, err := parseChunkCipher(key, objectName, header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	count, err := c.chunkCount(info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	size, err := c.contentSize(info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &decryptReaderAt{file: f, c: c, name: name, info: info, chunks: count, size: size}, nil
+}
+
+// ContentSize returns the size of the decrypted content of the named file,
+// from the size of the file, without decrypting it.
+func (o *EncryptingOpener) ContentSize(name string) (int64, error) {
+	f, _, c, err := o.openCipher(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info := fileInfo(f)
+	if info == nil {
+		return 0, fmt.Errorf("the size of %s is not available: %w", name, errors.ErrUnsupported)
+	}
+	return c.contentSize(info.Size())
+}
+
+func (o *EncryptingWriteOpener) encrypt(path string, f io.WriteCloser, err error) (io.WriteCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	key, name, err := o.ciphers.fileKey(o.logID, path)
+	if err == nil {
+		var c *chunkCipher
+		if c, err = newChunkCipher(key, name, o.ChunkSize); err == nil {
+			if _, err = f.Write(c.header); err == nil {
+				return &encryptWriter{file: f, c: c}, nil
+			}
+		}
+	}
+	return nil, errors.Join(err, f.Close())
+}
+
+// OpenCreate creates the file for writing encrypted content. It fails if the file already exists.
+func (o *EncryptingWriteOpener) OpenCreate(path string) (io.WriteCloser, error) {
+	f, err := o.Inner.OpenCreate(path)
+	return o.encrypt(path, f, err)
+}
+
+// OpenWrite opens the file for writing encrypted content, replacing any existing content.
+func (o *EncryptingWriteOpener) OpenWrite(path string) (io.WriteCloser, error) {
+	f, err := o.Inner.OpenWrite(path)
+	return o.encrypt(path, f, err)
+}
+
+// encryptWriter seals content a chunk at a time. A full chunk is held back
+// until more content arrives, as only then is it known not to be the last.
+type encryptWriter struct {
+	file     io.WriteCloser
+	c        *chunkCipher
+	buf      []byte
+	index    uint32
+	finished bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.finished {
+		return 0, fmt.Errorf("write after the encrypted content was finished: %w", fs.ErrClosed)
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.c.chunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(w.c.chunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) flush(last bool) error {
+	if _, err := w.file.Write(w.c.seal(w.index, last, w.buf)); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// finish seals the last chunk
+func (w *encryptWriter) finish() error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	return w.flush(true)
+}
+
+// Sync finishes the content, and syncs the file if it supports that
+func (w *encryptWriter) Sync() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if sw, ok := w.file.(syncer); ok {
+		return sw.Sync()
+	}
+	return nil
+}
+
+func (w *encryptWriter) Close() error {
+	return errors.Join(w.finish(), w.file.Close())
+}
+
+// decryptReader opens the chunks of an encrypted file in sequence
+type decryptReader struct {
+	file  io.ReadCloser
+	r     *bufio.Reader
+	c     *chunkCipher
+	name  string
+	index uint32
+	buf   []byte
+	last  bool
+}
+
+// Read fills p from as many chunks as necessary
+func (r *decryptReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			if r.last {
+				break
+			}
+			if err := r.next(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (r *decryptReader) next() error {
+	sealed := make([]byte, r.c.sealedChunkSize())
+	n, err := io.ReadFull(r.r, sealed)
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		r.last = true
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: %s is truncated", ErrDecrypt, r.name)
+	case err != nil:
+		return err
+	default:
+		if _, err := r.r.Peek(1); errors.Is(err, io.EOF) {
+			r.last = true
+		}
+	}
+	plaintext, err := r.c.open(r.index, r.last, sealed[:n])
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.name, err)
+	}
+	r.index++
+	r.buf = plaintext
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.file.Close()
+}
+
+// Stat returns the FileInfo of the encrypted file, if the opener provides it
+func (r *decryptReader) Stat() (fs.FileInfo, error) {
+	if info := fileInfo(r.file); info != nil {
+		return info, nil
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// decryptReaderAt opens the chunks of an encrypted file covering each read.
+// The most recently opened chunk is kept, for reads of adjacent ranges.
+type decryptReaderAt struct {
+	file   ReaderAtCloser
+	c      *chunkCipher
+	name   string
+	info   fs.FileInfo
+	chunks int64
+	size   int64
+
+	mu        sync.Mutex
+	lastIndex int64
+	lastChunk []byte
+}
+
+func (r *decryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / int64(r.c.chunkSize)
+		plaintext, err := r.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plaintext[off-index*int64(r.c.chunkSize):])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *decryptReaderAt) chunk(index int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastChunk != nil && r.lastIndex == index {
+		return r.lastChunk, nil
+	}
+	offset := int64(encryptedHeaderSize) + index*r.c.sealedChunkSize()
+	sealed := make([]byte, min(r.c.sealedChunkSize(), r.info.Size()-offset))
+	if _, err := r.file.ReadAt(sealed, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	plaintext, err := r.c.open(uint32(index), index == r.chunks-1, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", r.name, err)
+	}
+	r.lastIndex, r.lastChunk = index, plaintext
+	return plaintext, nil
+}
+
+func (r *decryptReaderAt) Close() error {
+	return r.file.Close()
+}
+
+func (r *decryptReaderAt) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+// statReaderAt returns the FileInfo of the opened file, if it provides it
+func statReaderAt(f ReaderAtCloser) fs.FileInfo {
+	st, ok := f.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	info, err := st.Stat()
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// contentSizer is implemented by Openers which can report the size of an
+// object's content more cheaply than reading it
+type contentSizer interface {
+	ContentSize(name string) (int64, error)
+}
+
+// openEncryption wraps the openers for encryption at rest, if a key provider is configured
+func (s *CachingStore) openEncryption() {
+	if s.Opts.Keys == nil {
+		return
+	}
+	if _, ok := s.Opts.ReadOpener.(*EncryptingOpener); !ok {
+		s.Opts.ReadOpener = NewEncryptingOpener(s.Opts.ReadOpener, s.Opts.Keys)
+	}
+	if _, ok := s.Opts.WriteOpener.(*EncryptingWriteOpener); !ok {
+		s.Opts.WriteOpener = NewEncryptingWriteOpener(s.Opts.WriteOpener, s.Opts.Keys)
+	}
+}
+
+// bindEncryption binds the encrypting openers to the log being selected.
+// Openers already bound to it are left in place, so the openers of a store
+// for a single log are only set once, and may be read without its lock.
+func (s *CachingStore) bindEncryption(logID storage.LogID) {
+	if o, ok := s.Opts.ReadOpener.(*EncryptingOpener); ok && !bytes.Equal(o.logID, logID) {
+		s.Opts.ReadOpener = o.ForLog(logID)
+	}
+	if o, ok := s.Opts.WriteOpener.(*EncryptingWriteOpener); ok && !bytes.Equal(o.logID, logID) {
+		s.Opts.WriteOpener = o.ForLog(logID)
+	}
+}
@@ -17,6 +17,14 @@ type WriteOpener interface {
 	OpenWrite(path string) (io.WriteCloser, error)
 }
 
+// AppendWriteOpener is implemented by WriteOpeners which can extend an
+// existing file in place. When available, Put uses it to write only the new
+// tail of a growing massif.
+type AppendWriteOpener interface {
+	WriteOpener
+	OpenAppend(path string) (io.WriteCloser, error)
+}
+
 type defaultWriteOpener struct {
 	CreatePerms os.FileMode
 }
@@ -35,6 +43,22 @@ func (*ReadOpener) Open(name string) (io.ReadCloser, error) {
 	return os.Open(fpath)
 }
 
+// OpenReaderAt opens the named file for random access reads
+func (*ReadOpener) OpenReaderAt(name string) (ReaderAtCloser, error) {
+	fpath, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fpath)
+}
+
+// plainFiles returns true if objects are read directly from their files, so
+// that the file content is the object content, or its compressed form.
+func (s *CachingStore) plainFiles() bool {
+	_, ok := s.Opts.ReadOpener.(*ReadOpener)
+	return ok
+}
+
 func NewFileOpener() Opener {
 	return &ReadOpener{}
 }
@@ -75,12 +99,13 @@ func (wo *defaultWriteOpener) OpenWrite(path string) (io.WriteCloser, error) {
 	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, wo.CreatePerms)
 }
 
-/*
-// OpenAppend ensures the named file exists and is writable. Writes are appended to any existing content.
-func OpenAppend(name string) (io.WriteCloser, error) {
-	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, ReadWriteAllPermission)
+// OpenAppend opens the existing file at the given path for writing. Writes are appended to the existing content.
+// It fails and returns an error if the file does not exist.
+func (wo *defaultWriteOpener) OpenAppend(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, wo.CreatePerms)
 }
 
+/*
 // OpenCreate ensures the named file exists and is writable. Existing content is truncated (replaced entirely).
 func OpenCreate(name string) (io.WriteCloser, error) {
 	return os.Create(name)
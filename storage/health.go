@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+var (
+	ErrUnhealthy = errors.New("log has missing, duplicate or orphaned objects")
+)
+
+// DuplicateObject records several files holding the same massif index
+type DuplicateObject struct {
+	MassifIndex uint32
+	Type        storage.ObjectType
+	// Paths are in listing order, the last is the one used by the cache
+	Paths []string
+}
+
+// LogHealth reports the consistency of the objects found for a log by PopulateCache
+type LogHealth struct {
+	// MissingMassifs are the ranges of massif indices between
+	// FirstMassifIndex and HeadMassifIndex with no massif file. Gaps are
+	// reported as ranges, as a stray file can make them arbitrarily large.
+	MissingMassifs []IndexRange
+	// Duplicates are the massif indices found in more than one file
+	Duplicates []DuplicateObject
+	// OrphanedCheckpoints are the indices of checkpoints with no massif file
+	OrphanedCheckpoints []uint32
+}
+
+func (h LogHealth) Healthy() bool {
+	return len(h.MissingMassifs) == 0 && len(h.Duplicates) == 0 && len(h.OrphanedCheckpoints) == 0
+}
+
+func (h LogHealth) String() string {
+	if h.Healthy() {
+		return "healthy"
+	}
+	var problems []string
+	if len(h.MissingMassifs) > 0 {
+		var missing []string
+		for _, r := range h.MissingMassifs {
+			missing = append(missing, r.String())
+		}
+		problems = append(problems, fmt.Sprintf("missing massifs [%s]", strings.Join(missing, " ")))
+	}
+	for _, d := range h.Duplicates {
+		problems = append(problems, fmt.Sprintf("massif %d %v in %d files", d.MassifIndex, d.Type, len(d.Paths)))
+	}
+	if len(h.OrphanedCheckpoints) > 0 {
+		problems = append(problems, fmt.Sprintf("checkpoints without massifs %v", h.OrphanedCheckpoints))
+	}
+	return strings.Join(problems, ", ")
+}
+
+// UnhealthyLogError is returned when selecting a log fails due to its health,
+// if FSOptions.FailUnhealthy is set.
+type UnhealthyLogError struct {
+	LogID  storage.LogID
+	Health LogHealth
+}
+
+func (e *UnhealthyLogError) Error() string {
+	return fmt.Sprintf("%v: log %x: %v", ErrUnhealthy, e.LogID, e.Health)
+}
+
+func (e *UnhealthyLogError) Unwrap() error {
+	return ErrUnhealthy
+}
+
+// Health returns the health of the selected log, as found by the most recent PopulateCache.
+func (s *CachingStore) Health() (LogHealth, error) {
+	if s.Selected == nil {
+		return LogHealth{}, storage.ErrLogNotSelected
+	}
+	return s.Selected.Health, nil
+}
+
+// noteDuplicate records that storagePath holds the same massif index as the
+// previously found path.
+func (s *CachingStore) noteDuplicate(massifIndex uint32, ty storage.ObjectType, previous, storagePath string) {
+	h := &s.Selected.Health
+	for i := range h.Duplicates {
+		d := &h.Duplicates[i]
+		if d.MassifIndex == massifIndex && d.Type == ty {
+			if !slices.Contains(d.Paths, storagePath) {
+				d.Paths = append(d.Paths, storagePath)
+			}
+			return
+		}
+	}
+	h.Duplicates = append(h.Duplicates, DuplicateObject{
+		MassifIndex: massifIndex, Type: ty, Paths: []string{previous, storagePath},
+	})
+}
+
+// checkHealth completes the health report for the selected log once its
+// objects have been found. It returns an *UnhealthyLogError if the log is
+// not healthy and FailUnhealthy is set.
+func (s *CachingStore) checkHealth() error {
+	h := &s.Selected.Health
+	h.MissingMassifs = nil
+	h.OrphanedCheckpoints = nil
+
+	var found []uint32
+	for massifIndex, paths := range s.Selected.MassifPaths {
+		if paths.Data != "" {
+			found = append(found, massifIndex)
+		}
+		if paths.Checkpoint != "" && paths.Data == "" {
+			h.OrphanedCheckpoints = append(h.OrphanedCheckpoints, massifIndex)
+		}
+	}
+	slices.Sort(found)
+	slices.Sort(h.OrphanedCheckpoints)
+
+	// The gaps are found between the massifs present, so the work is
+	// proportional to the number of files rather than the span of indices.
+	first, head := s.Selected.FirstMassifIndex, s.Selected.HeadMassifIndex
+	if first <= head {
+		next := uint64(first)
+		for _, massifIndex := range found {
+			if massifIndex < first || massifIndex > head {
+				continue
+			}
+			if uint64(massifIndex) > next {
+				h.MissingMassifs = append(h.MissingMassifs, IndexRange{First: uint32(next), Last: massifIndex - 1})
+			}
+			next = uint64(massifIndex) + 1
+		}
+		if next <= uint64(head) {
+			h.MissingMassifs = append(h.MissingMassifs, IndexRange{First: uint32(next), Last: head})
+		}
+	}
+
+	if s.Opts.FailUnhealthy && !h.Healthy() {
+		return &UnhealthyLogError{LogID: s.SelectedLogID, Health: *h}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+var (
+	ErrIndexMismatch = errors.New("object content does not match the index in its file name")
+)
+
+// IndexFromPath parses the massif index from a canonically named object
+// path, as produced by storage.ObjectPath, or its compressed form. It returns
+// false if the base name is not a decimal index followed by the extension.
+func IndexFromPath(storagePath string, ext string) (uint32, bool) {
+	base := strings.TrimSuffix(filepath.Base(storagePath), CompressedExt)
+	if !strings.HasSuffix(base, ext) {
+		return 0, false
+	}
+	digits := strings.TrimSuffix(base, ext)
+	if digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+		return 0, false
+	}
+	massifIndex, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(massifIndex), true
+}
+
+// verifyOnAccess checks that content read from a lazily discovered path
+// matches the massif index taken from its file name. Each path is checked
+// once, on the first read that returns enough data to check it.
+func (s *CachingStore) verifyOnAccess(massifIndex uint32, storagePath string, ty storage.ObjectType, data []byte) error {
+	if !s.Selected.Unverified[storagePath] {
+		return nil
+	}
+
+	var found uint32
+	switch ty {
+	case storage.ObjectMassifData, storage.ObjectMassifStart:
+		if len(data) < massifs.StartHeaderSize {
+			// not enough to check, leave it for a later read
+			return nil
+		}
+		start, err := decodeStart(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode massif start from %s: %w", storagePath, err)
+		}
+		found = start.MassifIndex
+
+	case storage.ObjectCheckpoint:
+		checkpt, err := decodeCheckpoint(*s.Opts.StorageOptions.CBORCodec, data)
+		if err != nil {
+			return fmt.Errorf("failed to decode checkpoint from %s: %w", storagePath, err)
+		}
+		found = uint32(massifs.MassifIndexFromMMRIndex(s.Opts.StorageOptions.MassifHeight, checkpt.MMRState.MMRSize-1))
+
+	default:
+		return fmt.Errorf("unsupported object type %v", ty)
+	}
+
+	if found != massifIndex {
+		return fmt.Errorf("%w: %s contains massif %d", ErrIndexMismatch, storagePath, found)
+	}
+	delete(s.Selected.Unverified, storagePath)
+	return nil
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	DefaultListLogsPageSize = 1000
+)
+
+// LogSummary describes a log found under the root directory. It is built
+// from the directory listings alone, no objects are read.
+type LogSummary struct {
+	LogID storage.LogID
+	// Dir is the log directory, containing the massifs and checkpoints directories
+	Dir         string
+	MassifCount int
+	// HeadMassifIndex and HeadSealIndex are taken from the object file names,
+	// and are only meaningful if MassifCount, or SealCount, is not zero.
+	HeadMassifIndex uint32
+	SealCount       int
+	HeadSealIndex   uint32
+	// Bytes is the total size of the massif and checkpoint files
+	Bytes int64
+}
+
+type ListLogsOptions struct {
+	// PageSize limits the number of logs returned. Zero selects DefaultListLogsPageSize.
+	PageSize int
+	// PageToken continues a previous listing. It is the NextPageToken returned by that listing.
+	PageToken string
+}
+
+type ListLogsResult struct {
+	Logs []LogSummary
+	// NextPageToken is empty if there are no more logs
+	NextPageToken string
+}
+
+// logsListing is the sorted listing of a logs directory, kept while the
+// directory is unchanged so that each page is found without listing it again.
+type logsListing struct {
+	ModTime  time.Time
+	ListedAt time.Time
+	Names    []string
+}
+
+// ListLogs enumerates the logs under RootDir, in the configured layout and
+// each of the built-in layouts. Logs are listed in a stable order, a page at
+// a time. The listing of each logs directory is cached until the directory
+// changes, so a page costs a search of the cached names, plus the summaries
+// of the logs on the page.
+func (s *CachingStore) ListLogs(ctx context.Context, opts ListLogsOptions) (ListLogsResult, error) {
+	if s.Opts.RootDir == "" {
+		return ListLogsResult{}, fmt.Errorf("a root dir is required to list logs")
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListLogsPageSize
+	}
+
+	var result ListLogsResult
+	var lastToken string
+	for _, provider := range s.listProviders() {
+		prefix := provider.LogsDir()
+		// The page token is "<prefix>/<name>", and sorts in listing order
+		if opts.PageToken != "" && opts.PageToken >= prefix+"/~" {
+			continue
+		}
+		prefixDir := filepath.Join(s.Opts.RootDir, filepath.FromSlash(prefix))
+		names, err := s.logDirNames(prefixDir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return ListLogsResult{}, fmt.Errorf("failed to list %s: %w", prefixDir, err)
+		}
+		// The names are sorted, so the tokens are too
+		start := sort.Search(len(names), func(i int) bool { return prefix+"/"+names[i] > opts.PageToken })
+		for _, name := range names[start:] {
+			if err := ctx.Err(); err != nil {
+				return ListLogsResult{}, err
+			}
+			token := prefix + "/" + name
+			logID, err := provider.ParseLogDirName(name)
+			if err != nil {
+				continue
+			}
+			if len(result.Logs) == pageSize {
+				result.NextPageToken = lastToken
+				return result, nil
+			}
+			summary, err := s.summarizeLog(provider, logID, filepath.Join(prefixDir, name))
+			if err != nil {
+				return ListLogsResult{}, err
+			}
+			result.Logs = append(result.Logs, summary)
+			lastToken = token
+		}
+	}
+	return result, nil
+}
+
+// logDirNames returns the sorted names of the directories in prefixDir,
+// re-listing it only if it has changed since it was last listed. As for
+// refreshDirs, a listing made within the modification time granularity of the
+// directory may have missed a change, and is not re-used.
+func (s *CachingStore) logDirNames(prefixDir string) ([]string, error) {
+	var modTime time.Time
+	if s.Opts.Archive == nil {
+		info, err := os.Stat(prefixDir)
+		if err != nil {
+			return nil, err
+		}
+		modTime = info.ModTime()
+	}
+	sh := s.shared
+	sh.mu.Lock()
+	listing, ok := sh.listings[prefixDir]
+	sh.mu.Unlock()
+	// Archives do not change
+	if ok && listing.ModTime.Equal(modTime) &&
+		(s.Opts.Archive != nil || listing.ListedAt.Sub(modTime) > mtimeGranularity(modTime)) {
+		return listing.Names, nil
+	}
+
+	listedAt := time.Now()
+	entries, err := s.readDir(prefixDir)
+	if err != nil {
+		return nil, err
+	}
+	// The entries are sorted by name
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sh.mu.Lock()
+	if sh.listings == nil {
+		sh.listings = make(map[string]*logsListing)
+	}
+	sh.listings[prefixDir] = &logsListing{ModTime: modTime, ListedAt: listedAt, Names: names}
+	sh.mu.Unlock()
+	return names, nil
+}
+
+// listProviders returns the configured layout and the built-in layouts,
+// one per logs directory, ordered by the logs directory.
+func (s *CachingStore) listProviders() []PrefixProvider {
+	providers := []PrefixProvider{}
+	seen := map[string]bool{}
+	for _, provider := range []PrefixProvider{
+		s.Opts.PrefixProvider, NewPrefixProvider(), NewDatatrailsPrefixProvider(), NewDatatrailsBlobPrefixProvider(),
+	} {
+		if provider == nil || seen[provider.LogsDir()] {
+			continue
+		}
+		seen[provider.LogsDir()] = true
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].LogsDir() < providers[j].LogsDir()
+	})
+	return providers
+}
+
+func (s *CachingStore) summarizeLog(provider PrefixProvider, logID storage.LogID, logDir string) (LogSummary, error) {
+	summary := LogSummary{LogID: logID, Dir: logDir}
+
+	for _, otype := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+		ext := s.Opts.MassifExtension
+		count, head := &summary.MassifCount, &summary.HeadMassifIndex
+		if otype == storage.ObjectCheckpoint {
+			ext = s.Opts.SealExtension
+			count, head = &summary.SealCount, &summary.HeadSealIndex
+		}
+		dir, err := provider.ObjectDir(otype)
+		if err != nil {
+			return LogSummary{}, err
+		}
+		dir = filepath.FromSlash(dir)
+
+		entries, err := s.readDir(filepath.Join(logDir, dir))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return LogSummary{}, fmt.Errorf("failed to list %s: %w", filepath.Join(logDir, dir), err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !hasObjectExt(entry.Name(), ext) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					// removed since the directory was listed
+					continue
+				}
+				return LogSummary{}, err
+			}
+			summary.Bytes += info.Size()
+			*count++
+			if massifIndex, ok := IndexFromPath(entry.Name(), ext); ok && massifIndex > *head {
+				*head = massifIndex
+			}
+		}
+	}
+	return summary, nil
+}
@@ -1,5 +1,11 @@
 package storage
 
+import (
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs"
+)
+
 type MassifStoragePaths struct {
 	Data       string
 	Checkpoint string
@@ -9,8 +15,42 @@ type LogCache struct {
 	MassifPaths      map[uint32]*MassifStoragePaths
 	MassifData       map[string][]byte
 	CheckpointData   map[string][]byte
+	Versions         map[string]VersionToken
 	FirstMassifIndex uint32
 	HeadMassifIndex  uint32
 	FirstSealIndex   uint32
 	HeadSealIndex    uint32
+
+	// Starts and Checkpoints hold the decoded forms of the cached data, keyed by path
+	Starts      map[string]*massifs.MassifStart
+	Checkpoints map[string]*massifs.Checkpoint
+	// RecoveryFindings are the results of the most recent recovery pass
+	RecoveryFindings []RecoveryFinding
+	// Excluded paths are left out of the cache due to unresolved recovery findings
+	Excluded map[string]bool
+	// Unverified paths were discovered from their file names and have not yet been read
+	Unverified map[string]bool
+	// Manifest is the persistent index for the log, if FSOptions.UseManifest is set
+	Manifest *LogManifest
+	// Evicted maps the paths whose data was dropped to honor the cache budget, or
+	// because the file changed, to the number of bytes to re-read, or -1 for all of it
+	Evicted map[string]int
+	// MassifRanges holds partial reads of massif data made by MassifReadAt
+	MassifRanges map[string]*RangeCache
+	// Health reports gaps, duplicates and orphaned checkpoints found by PopulateCache
+	Health LogHealth
+	// CorruptFiles were left out of the cache by PopulateCache, according to FSOptions.CorruptFiles
+	CorruptFiles []CorruptFile
+
+	// MassifsMTime and SealsMTime are the directory modification times when they were last listed
+	MassifsMTime int64
+	SealsMTime   int64
+	// ListedAt is when the directories were last listed. Files created
+	// within the modification time granularity of a listing may not change
+	// the times it recorded.
+	ListedAt time.Time
+	// Checksums holds the checksum sidecars read for partial reads, keyed by object path
+	Checksums map[string]CachedChecksum
+	// CheckedAt records when each path, and the log directories (""), were last checked for changes
+	CheckedAt map[string]time.Time
 }
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// LogHandle provides the reader and writer methods of a CachingStore for a
+// single log. Handles are safe for concurrent use, including handles for
+// different logs of the same store. Each log has its own lock, held for the
+// duration of each call through a handle to it, so calls for different logs
+// run concurrently. All handles share the store's cache budget and writer
+// locks.
+//
+// The cache behind handles is separate from that of the selected log. The
+// store's own reader and writer methods act on the selected log, and must
+// not be used concurrently with handles.
+type LogHandle struct {
+	store *CachingStore
+	logID storage.LogID
+}
+
+// Log returns a handle for the log, populating its cache if necessary. Files
+// left out of the log as corrupt are reported by the handle's CorruptFiles.
+func (s *CachingStore) Log(ctx context.Context, logId storage.LogID) (*LogHandle, error) {
+	ls := s.logStore(logId)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.activate(ctx, logId); err != nil {
+		return nil, err
+	}
+	return &LogHandle{store: ls, logID: bytes.Clone(logId)}, nil
+}
+
+// logStore returns the store behind the handles for the log, creating it if
+// necessary. It shares the options, cache budget and writer locks of s, and
+// caches only the one log.
+func (s *CachingStore) logStore(logId storage.LogID) *CachingStore {
+	sh := s.shared
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if ls, ok := sh.logStores[string(logId)]; ok {
+		return ls
+	}
+	ls := &CachingStore{
+		Opts:   sh.opts,
+		Logs:   make(map[string]*LogCache),
+		shared: sh,
+	}
+	ls.bindEncryption(logId)
+	if sh.logStores == nil {
+		sh.logStores = make(map[string]*CachingStore)
+	}
+	sh.logStores[string(logId)] = ls
+	return ls
+}
+
+// activate selects the log, re-using its existing cache if it has one. The
+// caller holds the store's lock.
+func (s *CachingStore) activate(ctx context.Context, logId storage.LogID) error {
+	s.dropPending()
+	if bytes.Equal(logId, s.SelectedLogID) && s.Selected != nil {
+		return nil
+	}
+	if c, ok := s.Logs[string(logId)]; ok {
+		// As for selectLog, the lock is taken before the log is selected
+		s.SelectedLogID, s.Selected = logId, nil
+		s.bindEncryption(logId)
+		if err := s.lockForWrite(ctx, WriterLockOnSelect); err != nil {
+			s.SelectedLogID = nil
+			return err
+		}
+		s.Selected = c
+		return nil
+	}
+	return s.selectLog(ctx, logId)
+}
+
+// LogID returns the id of the log the handle is for
+func (h *LogHandle) LogID() storage.LogID {
+	return h.logID
+}
+
+func (h *LogHandle) GetStorageOptions() massifs.StorageOptions {
+	return h.store.GetStorageOptions()
+}
+
+func (h *LogHandle) HasCapability(feature storage.StorageFeature) bool {
+	return h.store.HasCapability(feature)
+}
+
+func (h *LogHandle) HeadIndex(ctx context.Context, otype storage.ObjectType) (uint32, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return 0, err
+	}
+	return h.store.HeadIndex(ctx, otype)
+}
+
+func (h *LogHandle) MassifData(massifIndex uint32) ([]byte, bool, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(context.Background(), h.logID); err != nil {
+		return nil, false, err
+	}
+	return h.store.MassifData(massifIndex)
+}
+
+func (h *LogHandle) CheckpointData(massifIndex uint32) ([]byte, bool, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(context.Background(), h.logID); err != nil {
+		return nil, false, err
+	}
+	return h.store.CheckpointData(massifIndex)
+}
+
+func (h *LogHandle) MassifReadN(ctx context.Context, massifIndex uint32, n int) ([]byte, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.MassifReadN(ctx, massifIndex, n)
+}
+
+func (h *LogHandle) MassifView(ctx context.Context, massifIndex uint32) ([]byte, func(), error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, nil, err
+	}
+	return h.store.MassifView(ctx, massifIndex)
+}
+
+func (h *LogHandle) MassifReadAt(ctx context.Context, massifIndex uint32, offset, length int64) ([]byte, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.MassifReadAt(ctx, massifIndex, offset, length)
+}
+
+func (h *LogHandle) CheckpointRead(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.CheckpointRead(ctx, massifIndex)
+}
+
+func (h *LogHandle) Put(
+	ctx context.Context, massifIndex uint32, ty storage.ObjectType, data []byte,
+	failIfExists bool,
+) error {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(ctx, h.logID); err != nil {
+		return err
+	}
+	return h.store.Put(ctx, massifIndex, ty, data, failIfExists)
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"container/list"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// cacheKind distinguishes the separately cached forms of an object
+type cacheKind int
+
+const (
+	cachedMassif cacheKind = iota
+	cachedCheckpoint
+	cachedRanges
+)
+
+// cacheKey identifies a cached object across all logs, and all the stores sharing a cache budget
+type cacheKey struct {
+	store *CachingStore
+	logID string
+	path  string
+	kind  cacheKind
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	size int64
+}
+
+// cacheKey returns the key for an object of the selected log
+func (s *CachingStore) cacheKey(storagePath string, kind cacheKind) cacheKey {
+	return cacheKey{store: s, logID: string(s.SelectedLogID), path: storagePath, kind: kind}
+}
+
+// cacheMassif caches massif data for the selected log, subject to the configured byte budget.
+func (s *CachingStore) cacheMassif(storagePath string, data []byte) {
+	s.cacheDropRanges(storagePath)
+	delete(s.Selected.Starts, storagePath)
+	s.Selected.MassifData[storagePath] = data
+	delete(s.Selected.Evicted, storagePath)
+	s.cacheAdd(s.cacheKey(storagePath, cachedMassif), len(data))
+}
+
+// cacheCheckpoint caches checkpoint data for the selected log, subject to the configured byte budget.
+func (s *CachingStore) cacheCheckpoint(storagePath string, data []byte) {
+	delete(s.Selected.Checkpoints, storagePath)
+	s.Selected.CheckpointData[storagePath] = data
+	delete(s.Selected.Evicted, storagePath)
+	s.cacheAdd(s.cacheKey(storagePath, cachedCheckpoint), len(data))
+}
+
+// cacheDropRanges discards any partial reads cached for the massif, as they may no longer match its content
+func (s *CachingStore) cacheDropRanges(storagePath string) {
+	s.cacheDrop(storagePath, cachedRanges)
+}
+
+// cacheDrop discards the cached data of the given kind for an object of the selected log
+func (s *CachingStore) cacheDrop(storagePath string, kind cacheKind) {
+	s.logCacheDrop(string(s.SelectedLogID), s.Selected, storagePath, kind)
+}
+
+// logCacheDrop discards the cached data of the given kind for an object of any log
+func (s *CachingStore) logCacheDrop(logID string, c *LogCache, storagePath string, kind cacheKind) {
+	switch kind {
+	case cachedMassif:
+		delete(c.MassifData, storagePath)
+		delete(c.Starts, storagePath)
+	case cachedCheckpoint:
+		delete(c.CheckpointData, storagePath)
+		delete(c.Checkpoints, storagePath)
+	case cachedRanges:
+		delete(c.MassifRanges, storagePath)
+	}
+	sh := s.shared
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if el, ok := sh.lruIndex[cacheKey{store: s, logID: logID, path: storagePath, kind: kind}]; ok {
+		sh.remove(el)
+	}
+}
+
+// cacheTouch marks a cached object of the selected log as recently used
+func (s *CachingStore) cacheTouch(storagePath string, kind cacheKind) {
+	sh := s.shared
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if el, ok := sh.lruIndex[s.cacheKey(storagePath, kind)]; ok {
+		sh.lru.MoveToFront(el)
+	}
+}
+
+func (s *CachingStore) cacheAdd(key cacheKey, size int) {
+	if s.Opts.CacheBudget <= 0 {
+		return
+	}
+	sh := s.shared
+	sh.mu.Lock()
+	if sh.lru == nil {
+		sh.lru = list.New()
+		sh.lruIndex = make(map[cacheKey]*list.Element)
+	}
+	if el, ok := sh.lruIndex[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		sh.cachedBytes += int64(size) - entry.size
+		entry.size = int64(size)
+		sh.lru.MoveToFront(el)
+	} else {
+		sh.lruIndex[key] = sh.lru.PushFront(&cacheEntry{key: key, size: int64(size)})
+		sh.cachedBytes += int64(size)
+	}
+
+	// Always retain the most recent entry, even if it alone exceeds the budget
+	var evicted []*cacheEntry
+	for sh.cachedBytes > s.Opts.CacheBudget && sh.lru.Len() > 1 {
+		evicted = append(evicted, sh.remove(sh.lru.Back()))
+	}
+	sh.mu.Unlock()
+
+	for _, entry := range evicted {
+		s.evict(entry)
+	}
+}
+
+// remove takes an entry out of the budget. The caller holds the lock.
+func (sh *sharedState) remove(el *list.Element) *cacheEntry {
+	entry := sh.lru.Remove(el).(*cacheEntry)
+	delete(sh.lruIndex, entry.key)
+	sh.cachedBytes -= entry.size
+	return entry
+}
+
+// evict drops the cached bytes for an entry taken out of the budget. The
+// object remains known to its log, and is re-read through the Opener on the
+// next access. Entries of another store are dropped if its lock is free,
+// and otherwise by that store when it is next activated.
+func (s *CachingStore) evict(entry *cacheEntry) {
+	owner := entry.key.store
+	if owner != s {
+		if !owner.mu.TryLock() {
+			sh := s.shared
+			sh.mu.Lock()
+			if sh.pending == nil {
+				sh.pending = make(map[*CachingStore][]*cacheEntry)
+			}
+			sh.pending[owner] = append(sh.pending[owner], entry)
+			sh.mu.Unlock()
+			return
+		}
+		defer owner.mu.Unlock()
+	}
+	owner.dropEvicted(entry)
+}
+
+// dropPending drops the entries evicted by other stores while this one was busy
+func (s *CachingStore) dropPending() {
+	sh := s.shared
+	sh.mu.Lock()
+	pending := sh.pending[s]
+	delete(sh.pending, s)
+	sh.mu.Unlock()
+	for _, entry := range pending {
+		s.dropEvicted(entry)
+	}
+}
+
+func (s *CachingStore) dropEvicted(entry *cacheEntry) {
+	c, ok := s.logCache(entry.key.logID)
+	if !ok {
+		return
+	}
+	switch entry.key.kind {
+	case cachedMassif:
+		if _, ok := c.MassifData[entry.key.path]; !ok {
+			return
+		}
+		delete(c.MassifData, entry.key.path)
+		delete(c.Starts, entry.key.path)
+		c.Evicted[entry.key.path] = int(entry.size)
+		_ = s.unmapMassif(entry.key.path)
+	case cachedCheckpoint:
+		if _, ok := c.CheckpointData[entry.key.path]; !ok {
+			return
+		}
+		delete(c.CheckpointData, entry.key.path)
+		c.Evicted[entry.key.path] = int(entry.size)
+	case cachedRanges:
+		// ranges are simply re-read on the next miss
+		delete(c.MassifRanges, entry.key.path)
+	}
+}
+
+// logCache returns the cache for the log, which is the selected log cache
+// while it is being populated.
+func (s *CachingStore) logCache(logID string) (*LogCache, bool) {
+	if s.Selected != nil && logID == string(s.SelectedLogID) {
+		return s.Selected, true
+	}
+	c, ok := s.Logs[logID]
+	return c, ok
+}
+
+// CachedBytes returns the number of object bytes currently cached across all
+// logs, including those cached for handles. It is only maintained when a
+// CacheBudget is configured.
+func (s *CachingStore) CachedBytes() int64 {
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+	return s.shared.cachedBytes
+}
+
+// UnselectLog clears the selected log. Its cached data is retained.
+func (s *CachingStore) UnselectLog() {
+	s.SelectedLogID = nil
+	s.Selected = nil
+}
+
+// EvictLog drops all cached data for the log, unselecting it if it is the
+// selected log, and including the data cached for handles to the log. A
+// subsequent SelectLog, or call through a handle, repopulates the cache from
+// storage.
+func (s *CachingStore) EvictLog(logId storage.LogID) {
+	s.mu.Lock()
+	s.evictLog(string(logId))
+	s.mu.Unlock()
+
+	s.shared.mu.Lock()
+	ls, ok := s.shared.logStores[string(logId)]
+	s.shared.mu.Unlock()
+	if ok {
+		ls.mu.Lock()
+		ls.evictLog(string(logId))
+		ls.mu.Unlock()
+	}
+}
+
+// evictLog drops the cached data this store holds for the log. The caller holds the store's lock.
+func (s *CachingStore) evictLog(key string) {
+	c, ok := s.Logs[key]
+	if !ok {
+		return
+	}
+	sh := s.shared
+	var evicted []*cacheEntry
+	sh.mu.Lock()
+	if sh.lru != nil {
+		for el := sh.lru.Front(); el != nil; {
+			next := el.Next()
+			if k := el.Value.(*cacheEntry).key; k.store == s && k.logID == key {
+				evicted = append(evicted, sh.remove(el))
+			}
+			el = next
+		}
+	}
+	sh.mu.Unlock()
+	for _, entry := range evicted {
+		s.dropEvicted(entry)
+	}
+	for storagePath := range c.MassifData {
+		s.logCacheDrop(key, c, storagePath, cachedMassif)
+		_ = s.unmapMassif(storagePath)
+	}
+	delete(s.Logs, key)
+	if string(s.SelectedLogID) == key {
+		s.SelectedLogID = nil
+		s.Selected = nil
+	}
+}
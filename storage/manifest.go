@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+const (
+	ManifestFileName = "index.json"
+	manifestVersion  = 1
+)
+
+// LogManifest is a persistent index of the objects in a log directory. It
+// lets PopulateCache select a log without listing its directories or
+// decoding any headers. It is trusted only while the modification times of
+// the massifs and checkpoints directories match those it records, and only
+// if the listing it describes was made after those times, see current.
+type LogManifest struct {
+	Version      int    `json:"version"`
+	MassifHeight uint8  `json:"massifHeight"`
+	MassifsMTime int64  `json:"massifsMTime"`
+	SealsMTime   int64  `json:"sealsMTime"`
+	ListedAt     int64  `json:"listedAt"`
+	FirstMassif  uint32 `json:"firstMassif"`
+	HeadMassif   uint32 `json:"headMassif"`
+	FirstSeal    uint32 `json:"firstSeal"`
+	HeadSeal     uint32 `json:"headSeal"`
+
+	Massifs     []ManifestEntry `json:"massifs"`
+	Checkpoints []ManifestEntry `json:"checkpoints"`
+
+	// checked notes the paths whose content has been checked against their entry
+	checked map[string]bool
+}
+
+// ManifestEntry describes one object. The digest is only recorded for
+// objects which will not change again, checkpoints and massifs which are
+// sealed, see isSealed. FileSize and FileMTime identify the file the digest
+// was taken from, so a file replaced since is not checked against it.
+type ManifestEntry struct {
+	MassifIndex uint32 `json:"massifIndex"`
+	// Name is the file name, relative to the massifs or checkpoints directory
+	Name string `json:"name"`
+	// Size and SHA256 are of the object content, before any compression or encryption
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	FileSize  int64  `json:"fileSize,omitempty"`
+	FileMTime int64  `json:"fileMTime,omitempty"`
+}
+
+// current returns true if the manifest describes directories with the given
+// modification times. A listing made within the modification time
+// granularity of a directory may have missed a file created in the same
+// tick, so such a manifest is never current.
+func (m *LogManifest) current(massifsMTime, sealsMTime int64) bool {
+	if m.MassifsMTime != massifsMTime || m.SealsMTime != sealsMTime {
+		return false
+	}
+	listedAt := time.Unix(0, m.ListedAt)
+	return !listedWithin(listedAt, massifsMTime) && !listedWithin(listedAt, sealsMTime)
+}
+
+// entry returns the entry for storagePath, or nil if there is none
+func (m *LogManifest) entry(storagePath string, opts Options) *ManifestEntry {
+	name := filepath.Base(storagePath)
+	for _, ext := range []string{opts.MassifExtension, opts.SealExtension} {
+		massifIndex, ok := IndexFromPath(storagePath, ext)
+		if !ok {
+			continue
+		}
+		entries := m.Massifs
+		if ext == opts.SealExtension {
+			entries = m.Checkpoints
+		}
+		i, found := slices.BinarySearchFunc(entries, massifIndex, compareEntry)
+		if found && entries[i].Name == name {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+func compareEntry(e ManifestEntry, massifIndex uint32) int {
+	return cmp.Compare(e.MassifIndex, massifIndex)
+}
+
+// manifestEnabled returns true if the selected log is indexed by a manifest.
+// Archives, and explicitly configured files, are always listed.
+func (s *CachingStore) manifestEnabled() bool {
+	return s.Opts.UseManifest && s.Opts.RootDir != "" && s.Opts.Archive == nil &&
+		s.Opts.MassifFile == "" && s.Opts.CheckpointFile == ""
+}
+
+// manifestPath returns the path of the manifest file for the selected log
+func (s *CachingStore) manifestPath() (string, error) {
+	logDir, err := s.LogDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(logDir, ManifestFileName), nil
+}
+
+// dirMTimes returns the modification times of the massifs and checkpoints directories, zero if absent
+func (s *CachingStore) dirMTimes() (int64, int64, error) {
+	var mtimes [2]int64
+	if s.Opts.Archive != nil {
+		// archives never change
+		return 0, 0, nil
+	}
+	for i, ty := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+		dir, err := s.PrefixPath(ty)
+		if err != nil {
+			return 0, 0, err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return 0, 0, err
+		}
+		mtimes[i] = info.ModTime().UnixNano()
+	}
+	return mtimes[0], mtimes[1], nil
+}
+
+// readManifest returns the manifest saved for the selected log, or nil if
+// there is none, or it can not be decoded, in which case it is rebuilt.
+func (s *CachingStore) readManifest() (*LogManifest, error) {
+	manifestPath, err := s.manifestPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.Opts.ReadOpener.Open(manifestPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open manifest %s: %w", manifestPath, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", manifestPath, err)
+	}
+	m := &LogManifest{}
+	if err := json.Unmarshal(data, m); err != nil || m.Version != manifestVersion {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// populateFromManifest fills the selected log cache from the manifest, if
+// it is current for the directory modification times taken before
+// PopulateCache would list the directories. It returns false if it is not,
+// in which case the cache is left untouched. The objects are read, and
+// checked against the manifest indices and digests, on first access.
+func (s *CachingStore) populateFromManifest(m *LogManifest) (bool, error) {
+	if m == nil || m.MassifHeight != s.Opts.StorageOptions.MassifHeight {
+		return false, nil
+	}
+	if !m.current(s.Selected.MassifsMTime, s.Selected.SealsMTime) {
+		return false, nil
+	}
+
+	massifsDir, err := s.PrefixPath(storage.ObjectMassifData)
+	if err != nil {
+		return false, err
+	}
+	checkpointsDir, err := s.PrefixPath(storage.ObjectCheckpoint)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range m.Massifs {
+		storagePath := filepath.Join(massifsDir, e.Name)
+		if s.Selected.Excluded[storagePath] {
+			continue
+		}
+		s.Selected.Unverified[storagePath] = true
+		s.addMassifPath(e.MassifIndex, storagePath)
+	}
+	for _, e := range m.Checkpoints {
+		storagePath := filepath.Join(checkpointsDir, e.Name)
+		if s.Selected.Excluded[storagePath] {
+			continue
+		}
+		s.Selected.Unverified[storagePath] = true
+		s.addCheckpointPath(e.MassifIndex, storagePath)
+	}
+	s.Selected.Manifest = m
+	return true, nil
+}
+
+// newManifest returns a manifest describing the selected log cache as it was
+// listed. The directory modification times are those taken before the
+// listing, so a file created while listing leaves the manifest out of date,
+// rather than missing the file. The digests of the previous manifest are kept
+// for files of the same name, they are only used while the file is unchanged.
+func (s *CachingStore) newManifest(previous *LogManifest) *LogManifest {
+	m := &LogManifest{
+		Version:      manifestVersion,
+		MassifHeight: s.Opts.StorageOptions.MassifHeight,
+		MassifsMTime: s.Selected.MassifsMTime,
+		SealsMTime:   s.Selected.SealsMTime,
+		ListedAt:     s.Selected.ListedAt.UnixNano(),
+	}
+	for massifIndex, paths := range s.Selected.MassifPaths {
+		if paths.Data != "" {
+			m.Massifs = append(m.Massifs, ManifestEntry{MassifIndex: massifIndex, Name: filepath.Base(paths.Data)})
+		}
+		if paths.Checkpoint != "" {
+			m.Checkpoints = append(m.Checkpoints, ManifestEntry{MassifIndex: massifIndex, Name: filepath.Base(paths.Checkpoint)})
+		}
+	}
+	for _, entries := range [][]ManifestEntry{m.Massifs, m.Checkpoints} {
+		slices.SortFunc(entries, func(a, b ManifestEntry) int { return cmp.Compare(a.MassifIndex, b.MassifIndex) })
+	}
+	if previous != nil {
+		for _, pair := range [][2][]ManifestEntry{{m.Massifs, previous.Massifs}, {m.Checkpoints, previous.Checkpoints}} {
+			for i, e := range pair[0] {
+				j, found := slices.BinarySearchFunc(pair[1], e.MassifIndex, compareEntry)
+				if found && pair[1][j].Name == e.Name {
+					pair[0][i] = pair[1][j]
+				}
+			}
+		}
+	}
+	return m
+}
+
+// rebuildManifest saves a new manifest describing the selected log cache,
+// as it was just listed. No object is read, digests are only added for
+// content already cached.
+func (s *CachingStore) rebuildManifest(previous *LogManifest) error {
+	s.Selected.Manifest = s.newManifest(previous)
+	if err := s.reconcileDigests(); err != nil {
+		return err
+	}
+	return s.saveManifest()
+}
+
+// manifestCurrent returns true if the manifest of the selected log still
+// describes the directories. It is called by writers, with the writer lock
+// held, before they change the log, see updateManifest. A log listed
+// without a manifest, because it was empty, is given one.
+func (s *CachingStore) manifestCurrent() (bool, error) {
+	if !s.manifestEnabled() {
+		return false, nil
+	}
+	massifsMTime, sealsMTime, err := s.dirMTimes()
+	if err != nil {
+		return false, err
+	}
+	if s.Selected.Manifest == nil {
+		s.Selected.Manifest = s.newManifest(nil)
+	}
+	return s.Selected.Manifest.current(massifsMTime, sealsMTime), nil
+}
+
+// updateManifest records an object just written by this store, whose
+// content is data. current is the result of manifestCurrent before the
+// write. If it is false, some other change may be missing from the manifest,
+// so the update is kept in memory, and the manifest is rebuilt by the next
+// PopulateCache to list the log. Otherwise the manifest is saved if the
+// entry changed, or if the write changed a directory modification time, as
+// replacing a file does. Appending to the head massif in place changes
+// neither, and the head massif has no digest to update.
+func (s *CachingStore) updateManifest(massifIndex uint32, ty storage.ObjectType, storagePath string, data []byte, current bool) error {
+	if !s.manifestEnabled() || s.Selected.Manifest == nil {
+		return nil
+	}
+	m := s.Selected.Manifest
+	entries := &m.Massifs
+	if ty == storage.ObjectCheckpoint {
+		entries = &m.Checkpoints
+	}
+	e := ManifestEntry{MassifIndex: massifIndex, Name: filepath.Base(storagePath)}
+	if s.isSealed(massifIndex) {
+		s.setDigest(&e, storagePath, data)
+	}
+	delete(m.checked, storagePath)
+
+	changed := true
+	i, found := slices.BinarySearchFunc(*entries, massifIndex, compareEntry)
+	if found {
+		changed = (*entries)[i] != e
+		(*entries)[i] = e
+	} else {
+		*entries = slices.Insert(*entries, i, e)
+	}
+	// The write may have sealed an earlier massif
+	if err := s.reconcileDigests(); err != nil {
+		return err
+	}
+	if !current {
+		return nil
+	}
+
+	listedAt := time.Now()
+	massifsMTime, sealsMTime, err := s.dirMTimes()
+	if err != nil {
+		return err
+	}
+	if !changed && m.MassifsMTime == massifsMTime && m.SealsMTime == sealsMTime {
+		return nil
+	}
+	m.MassifsMTime, m.SealsMTime, m.ListedAt = massifsMTime, sealsMTime, listedAt.UnixNano()
+	return s.saveManifest()
+}
+
+// setDigest records the digest of data, the content of storagePath, in the
+// entry, identifying the file by the version the store recorded for it.
+func (s *CachingStore) setDigest(e *ManifestEntry, storagePath string, data []byte) {
+	v, ok := s.Selected.Versions[storagePath]
+	if !ok || v.ContentSize != int64(len(data)) || len(data) == 0 {
+		return
+	}
+	sum := sha256.Sum256(data)
+	e.Size, e.SHA256 = int64(len(data)), hex.EncodeToString(sum[:])
+	e.FileSize, e.FileMTime = v.Size, v.ModTime.UnixNano()
+}
+
+// reconcileDigests brings the digests in the manifest up to date with the
+// selected log cache. Massifs which are not sealed have none. A digest is
+// dropped if the store has since seen a different version of its file, and
+// added for sealed objects whose whole content is cached.
+func (s *CachingStore) reconcileDigests() error {
+	m := s.Selected.Manifest
+	for _, ty := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+		dir, err := s.PrefixPath(ty)
+		if err != nil {
+			return err
+		}
+		entries, cached := m.Massifs, s.Selected.MassifData
+		if ty == storage.ObjectCheckpoint {
+			entries, cached = m.Checkpoints, s.Selected.CheckpointData
+		}
+		for i := range entries {
+			e := &entries[i]
+			if !s.isSealed(e.MassifIndex) {
+				*e = ManifestEntry{MassifIndex: e.MassifIndex, Name: e.Name}
+				continue
+			}
+			storagePath := filepath.Join(dir, e.Name)
+			v, ok := s.Selected.Versions[storagePath]
+			if e.SHA256 != "" && ok && (v.Size != e.FileSize || v.ModTime.UnixNano() != e.FileMTime) {
+				*e = ManifestEntry{MassifIndex: e.MassifIndex, Name: e.Name}
+			}
+			if e.SHA256 == "" {
+				s.setDigest(e, storagePath, cached[storagePath])
+			}
+		}
+	}
+	return nil
+}
+
+// verifyManifestEntry checks the whole content of an object, just read from
+// a file described by info, against the digest in the manifest. Only files
+// unchanged since the digest was recorded are checked, and each only once.
+func (s *CachingStore) verifyManifestEntry(storagePath string, info fs.FileInfo, data []byte) error {
+	m := s.Selected.Manifest
+	if !s.Opts.UseManifest || m == nil || info == nil || m.checked[storagePath] {
+		return nil
+	}
+	e := m.entry(storagePath, s.Opts)
+	if e == nil || e.SHA256 == "" || info.Size() != e.FileSize || info.ModTime().UnixNano() != e.FileMTime {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); int64(len(data)) != e.Size || actual != e.SHA256 {
+		return &ChecksumError{Path: storagePath, Expected: e.SHA256, Actual: actual}
+	}
+	if m.checked == nil {
+		m.checked = make(map[string]bool)
+	}
+	m.checked[storagePath] = true
+	return nil
+}
+
+// saveManifest writes the manifest of the selected log. The directory
+// modification times it records are set by the caller, from before the
+// listing, or the write, it describes.
+func (s *CachingStore) saveManifest() error {
+	m := s.Selected.Manifest
+	m.FirstMassif, m.HeadMassif = s.Selected.FirstMassifIndex, s.Selected.HeadMassifIndex
+	m.FirstSeal, m.HeadSeal = s.Selected.FirstSealIndex, s.Selected.HeadSealIndex
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	manifestPath, err := s.manifestPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath), s.Opts.DirCreateMode); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", manifestPath, err)
+	}
+	// The manifest lives outside the massifs and checkpoints directories, so
+	// replacing it does not change the modification times it records.
+	return s.writeAtomic(manifestPath, data, false)
+}
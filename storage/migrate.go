@@ -0,0 +1,604 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// MigrateMode selects how objects are transferred to the target layout
+type MigrateMode int
+
+const (
+	// MigrateLink hard links each object into the target layout, leaving the source in place
+	MigrateLink MigrateMode = iota
+	// MigrateMove moves each object into the target layout
+	MigrateMove
+)
+
+// MigrateOutcome records what Migrate did with an object
+type MigrateOutcome int
+
+const (
+	// MigrateTransferred means the object was linked, moved or copied to the
+	// target. In a dry run, it means the object would have been.
+	MigrateTransferred MigrateOutcome = iota
+	// MigrateAlreadyPresent means the target already has the same content,
+	// typically because an earlier run was interrupted.
+	MigrateAlreadyPresent
+	// MigrateConflict means the target has different content for the same
+	// massif index. Neither file is changed.
+	MigrateConflict
+	// MigrateInvalid means the source object failed verification, and was not migrated
+	MigrateInvalid
+)
+
+func (o MigrateOutcome) String() string {
+	switch o {
+	case MigrateTransferred:
+		return "transferred"
+	case MigrateAlreadyPresent:
+		return "already present"
+	case MigrateConflict:
+		return "conflict"
+	case MigrateInvalid:
+		return "invalid"
+	default:
+		return "unknown outcome " + strconv.Itoa(int(o))
+	}
+}
+
+type MigrateOptions struct {
+	// From is the layout to migrate from
+	From PrefixProvider
+	// To is the layout to migrate to. Nil selects the layout configured for the store.
+	To   PrefixProvider
+	Mode MigrateMode
+	// DryRun verifies the objects and reports what would be done, without changing anything
+	DryRun bool
+	// LogIDs limits the migration to the given logs. If empty, every log found in the From layout is migrated.
+	LogIDs []storage.LogID
+}
+
+type MigrateItem struct {
+	LogID       storage.LogID
+	MassifIndex uint32
+	Type        storage.ObjectType
+	Source      string
+	// Target is not set for invalid objects
+	Target  string
+	Outcome MigrateOutcome
+	Detail  string
+}
+
+func (i MigrateItem) String() string {
+	s := fmt.Sprintf("%v %s", i.Outcome, i.Source)
+	if i.Target != "" {
+		s += " -> " + i.Target
+	}
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	return s
+}
+
+type MigrateResult struct {
+	Items []MigrateItem
+}
+
+// Count returns the number of objects with the outcome
+func (r MigrateResult) Count(outcome MigrateOutcome) int {
+	n := 0
+	for _, item := range r.Items {
+		if item.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// Conflicts returns the objects which exist in both layouts with different content
+func (r MigrateResult) Conflicts() []MigrateItem {
+	var conflicts []MigrateItem
+	for _, item := range r.Items {
+		if item.Outcome == MigrateConflict {
+			conflicts = append(conflicts, item)
+		}
+	}
+	return conflicts
+}
+
+// Migrate transfers the massifs and checkpoints of logs under RootDir from
+// one on disk layout to another. The selected log, and the cache, are not
+// changed.
+//
+// Each massif start header is decoded and its size checked against the
+// massif height, and each checkpoint MMRSize is checked against the massif
+// data, before the object is transferred. Objects which fail verification
+// are reported and left in place.
+//
+// Every object is transferred atomically, and objects already present in
+// the target with the same content are skipped. An interrupted migration is
+// resumed by running it again. Objects present in the target with different
+// content are reported as conflicts, and neither copy is changed.
+//
+// Objects are hard linked where possible, and copied if the layouts are on
+// different file systems.
+//
+// The writer lock for each log is held, in both layouts, while the log is
+// migrated, see lockMigration. Writers which do not take the lock must not
+// write a log while it is migrated. A dry run changes nothing, and takes no
+// locks.
+func (s *CachingStore) Migrate(ctx context.Context, opts MigrateOptions) (MigrateResult, error) {
+	if s.Opts.RootDir == "" {
+		return MigrateResult{}, fmt.Errorf("a root dir is required to migrate logs")
+	}
+	if s.Opts.Archive != nil {
+		return MigrateResult{}, ErrReadOnly
+	}
+	if opts.From == nil {
+		return MigrateResult{}, fmt.Errorf("a layout to migrate from is required")
+	}
+	if opts.To == nil {
+		opts.To = s.Opts.PrefixProvider
+	}
+
+	logIDs := opts.LogIDs
+	if len(logIDs) == 0 {
+		var err error
+		if logIDs, err = s.layoutLogIDs(opts.From); err != nil {
+			return MigrateResult{}, err
+		}
+	}
+
+	var result MigrateResult
+	for _, logID := range logIDs {
+		if err := s.migrateLog(ctx, opts, logID, &result); err != nil {
+			return result, fmt.Errorf("failed to migrate log %x: %w", logID, err)
+		}
+	}
+	return result, nil
+}
+
+// layoutLogIDs returns the ids of the logs present in the layout
+func (s *CachingStore) layoutLogIDs(provider PrefixProvider) ([]storage.LogID, error) {
+	logsDir := filepath.Join(s.Opts.RootDir, filepath.FromSlash(provider.LogsDir()))
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list %s: %w", logsDir, err)
+	}
+	var logIDs []storage.LogID
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if logID, err := provider.ParseLogDirName(entry.Name()); err == nil {
+			logIDs = append(logIDs, logID)
+		}
+	}
+	return logIDs, nil
+}
+
+// layoutLogDir returns the directory for the log in the layout
+func (s *CachingStore) layoutLogDir(provider PrefixProvider, logID storage.LogID) (string, error) {
+	name, err := provider.LogDirName(logID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Opts.RootDir, filepath.FromSlash(provider.LogsDir()), name), nil
+}
+
+// layoutDir returns the directory for objects of the type for the log in the layout
+func (s *CachingStore) layoutDir(provider PrefixProvider, logID storage.LogID, otype storage.ObjectType) (string, error) {
+	logDir, err := s.layoutLogDir(provider, logID)
+	if err != nil {
+		return "", err
+	}
+	dir, err := provider.ObjectDir(otype)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(logDir, filepath.FromSlash(dir)), nil
+}
+
+// lockMigration takes the writer lock for the log in both layouts, so that
+// stores using either layout do not write the log while it is migrated. It
+// waits for the locks unless WriterLockNoWait is set. A lock this store
+// already holds for the log, in its own layout, is used as it is. On
+// platforms without advisory locks, no lock is taken, as for Put.
+func (s *CachingStore) lockMigration(ctx context.Context, opts MigrateOptions, logID storage.LogID) (func() error, error) {
+	var held []*os.File
+	unlock := func() error {
+		var errs []error
+		for _, f := range held {
+			errs = append(errs, unlockFile(f), f.Close())
+		}
+		return errors.Join(errs...)
+	}
+
+	ownDir, err := s.layoutLogDir(s.Opts.PrefixProvider, logID)
+	if err != nil {
+		return nil, err
+	}
+	locked := make(map[string]bool)
+	for _, provider := range []PrefixProvider{opts.From, opts.To} {
+		logDir, err := s.layoutLogDir(provider, logID)
+		if err != nil {
+			return nil, errors.Join(err, unlock())
+		}
+		if locked[logDir] || (logDir == ownDir && s.holdsLock(logID)) {
+			continue
+		}
+		locked[logDir] = true
+		var f *os.File
+		tryLock := func() (err error) {
+			f, err = s.lockFile(logDir)
+			return err
+		}
+		if s.Opts.WriterLockNoWait {
+			err = tryLock()
+		} else {
+			err = pollLock(ctx, tryLock)
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(err, unlock())
+		}
+		held = append(held, f)
+	}
+	return unlock, nil
+}
+
+func (s *CachingStore) migrateLog(ctx context.Context, opts MigrateOptions, logID storage.LogID, result *MigrateResult) (err error) {
+	if !opts.DryRun {
+		unlock, err := s.lockMigration(ctx, opts, logID)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, unlock())
+		}()
+	}
+
+	// The massifs are migrated first, so their extents are known when the checkpoints are checked
+	extents := make(map[uint32]uint64)
+	reader := s.logReader(logID)
+
+	for _, otype := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+		ext := s.Opts.MassifExtension
+		if otype == storage.ObjectCheckpoint {
+			ext = s.Opts.SealExtension
+		}
+		sourceDir, err := s.layoutDir(opts.From, logID, otype)
+		if err != nil {
+			return err
+		}
+		targetDir, err := s.layoutDir(opts.To, logID, otype)
+		if err != nil {
+			return err
+		}
+		if sourceDir == targetDir {
+			return fmt.Errorf("the source and target layouts are the same")
+		}
+
+		sourcePaths, err := NewSuffixDirLister(ext).ListFiles(sourceDir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("failed to list %s: %w", sourceDir, err)
+		}
+
+		created := false
+		for _, sourcePath := range sourcePaths {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := MigrateItem{LogID: logID, Type: otype, Source: sourcePath}
+
+			var detail string
+			if otype == storage.ObjectCheckpoint {
+				item.MassifIndex, detail = reader.verifyMigratingCheckpoint(sourcePath, extents, opts.To, logID)
+			} else {
+				item.MassifIndex, detail = reader.verifyMigratingMassif(sourcePath, extents)
+			}
+			if detail != "" {
+				item.Outcome, item.Detail = MigrateInvalid, detail
+				result.Items = append(result.Items, item)
+				continue
+			}
+
+			if item.Target, err = storage.ObjectPath(targetDir+"/", logID, item.MassifIndex, otype); err != nil {
+				return err
+			}
+			if IsCompressed(sourcePath) {
+				item.Target += CompressedExt
+			}
+			if !opts.DryRun && !created {
+				if err := os.MkdirAll(targetDir, s.Opts.DirCreateMode); err != nil {
+					return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+				}
+				created = true
+			}
+			if item.Outcome, item.Detail, err = s.migrateObject(item.Source, item.Target, opts); err != nil {
+				return err
+			}
+			result.Items = append(result.Items, item)
+		}
+	}
+	return nil
+}
+
+// logReader returns a store for reading the files of the log without
+// selecting it, its openers are bound to the log. It has no cache, so only
+// methods which do not modify the store may be called on it.
+func (s *CachingStore) logReader(logID storage.LogID) *CachingStore {
+	r := &CachingStore{Opts: s.Opts, shared: s.shared}
+	r.bindEncryption(logID)
+	return r
+}
+
+// verifyMigratingMassif checks the massif start header and size, and records
+// the extent of the massif. It returns a non empty detail if the massif is
+// not valid.
+func (s *CachingStore) verifyMigratingMassif(storagePath string, extents map[uint32]uint64) (uint32, string) {
+	start, extent, detail := s.massifExtent(storagePath)
+	if detail != "" {
+		return 0, detail
+	}
+	if massifIndex, ok := IndexFromPath(storagePath, s.Opts.MassifExtension); ok && massifIndex != start.MassifIndex {
+		return 0, fmt.Sprintf("%v: contains massif %d", ErrIndexMismatch, start.MassifIndex)
+	}
+	extents[start.MassifIndex] = extent
+	return start.MassifIndex, ""
+}
+
+// verifyMigratingCheckpoint checks the checkpoint decodes, and that its
+// MMRSize does not exceed the massif data. Massifs transferred by an earlier
+// run are checked in the target layout. It returns a non empty detail if
+// the checkpoint is not valid.
+func (s *CachingStore) verifyMigratingCheckpoint(
+	storagePath string, extents map[uint32]uint64, to PrefixProvider, logID storage.LogID) (uint32, string) {
+
+	l, err := s.loadCheckpoint(storagePath)
+	if err != nil {
+		return 0, err.Error()
+	}
+	if massifIndex, ok := IndexFromPath(storagePath, s.Opts.SealExtension); ok && massifIndex != l.massifIndex {
+		return 0, fmt.Sprintf("%v: contains massif %d", ErrIndexMismatch, l.massifIndex)
+	}
+
+	extent, ok := extents[l.massifIndex]
+	if !ok {
+		targetDir, err := s.layoutDir(to, logID, storage.ObjectMassifData)
+		if err != nil {
+			return 0, err.Error()
+		}
+		targetPath, err := storage.ObjectPath(targetDir+"/", logID, l.massifIndex, storage.ObjectMassifData)
+		if err != nil {
+			return 0, err.Error()
+		}
+		if _, err := os.Stat(targetPath); err != nil {
+			targetPath += CompressedExt
+		}
+		if _, err := os.Stat(targetPath); err != nil {
+			return 0, fmt.Sprintf("checkpoint mmr size %d, massif %d not present", l.checkpt.MMRState.MMRSize, l.massifIndex)
+		}
+		var detail string
+		if _, extent, detail = s.massifExtent(targetPath); detail != "" {
+			return 0, fmt.Sprintf("massif %d in the target layout: %s", l.massifIndex, detail)
+		}
+	}
+	if mmrSize := l.checkpt.MMRState.MMRSize; mmrSize > extent {
+		return 0, fmt.Sprintf("checkpoint mmr size %d, massif %d data ends at %d", mmrSize, l.massifIndex, extent)
+	}
+	return l.massifIndex, ""
+}
+
+// massifExtent returns the massif start header, and the mmr size covered by
+// the massif data. It returns a non empty detail if the massif is not valid.
+func (s *CachingStore) massifExtent(storagePath string) (*massifs.MassifStart, uint64, string) {
+	l, err := s.loadMassifStart(storagePath)
+	if err != nil {
+		return nil, 0, err.Error()
+	}
+	if l.start.MassifHeight != s.Opts.StorageOptions.MassifHeight {
+		return nil, 0, fmt.Sprintf(
+			"massif height %d does not match the configured height %d", l.start.MassifHeight, s.Opts.StorageOptions.MassifHeight)
+	}
+	size, err := s.objectSize(storagePath)
+	if err != nil {
+		return nil, 0, err.Error()
+	}
+	logStart, detail := massifSizeDetail(l.start, size)
+	if detail != "" {
+		return nil, 0, detail
+	}
+	return l.start, l.start.FirstIndex + uint64(size-logStart)/massifs.ValueBytes, ""
+}
+
+// migrateObject transfers a single verified object, unless the target already exists
+func (s *CachingStore) migrateObject(source, target string, opts MigrateOptions) (MigrateOutcome, string, error) {
+
+	exists, same, err := sameContent(source, target)
+	if err != nil {
+		return 0, "", err
+	}
+	if exists && !same {
+		return MigrateConflict, "the target has different content", nil
+	}
+	if opts.DryRun {
+		if exists {
+			return MigrateAlreadyPresent, "", nil
+		}
+		return MigrateTransferred, "", nil
+	}
+
+	outcome, detail := MigrateAlreadyPresent, ""
+	if !exists {
+		outcome = MigrateTransferred
+		copied, err := s.transfer(source, target)
+		if err != nil {
+			return 0, "", err
+		}
+		if copied {
+			detail = "copied"
+		}
+	}
+	if err := s.migrateChecksum(source, target, opts.Mode); err != nil {
+		return 0, "", err
+	}
+	if opts.Mode == MigrateMove {
+		if err := os.Remove(source); err != nil {
+			return 0, "", fmt.Errorf("failed to remove %s after migrating it: %w", source, err)
+		}
+	}
+	return outcome, detail, nil
+}
+
+// migrateChecksum transfers the checksum sidecar of a migrated object, if it has one
+func (s *CachingStore) migrateChecksum(source, target string, mode MigrateMode) error {
+	sourceSidecar, targetSidecar := ChecksumPath(source), ChecksumPath(target)
+	if _, err := os.Stat(sourceSidecar); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	exists, _, err := sameContent(sourceSidecar, targetSidecar)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := s.transfer(sourceSidecar, targetSidecar); err != nil {
+			return err
+		}
+	}
+	if mode == MigrateMove {
+		if err := os.Remove(sourceSidecar); err != nil {
+			return fmt.Errorf("failed to remove %s after migrating it: %w", sourceSidecar, err)
+		}
+	}
+	return nil
+}
+
+// transfer hard links source to target, or copies it if it can not be
+// linked. It never replaces an existing target.
+func (s *CachingStore) transfer(source, target string) (bool, error) {
+	err := os.Link(source, target)
+	if err == nil {
+		if err = syncDir(filepath.Dir(target)); err != nil {
+			return false, fmt.Errorf("failed to sync directory for %s: %w", target, err)
+		}
+		return false, nil
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return false, fmt.Errorf("failed to link %s to %s: %w", source, target, err)
+	}
+
+	if err := s.copyFile(source, target); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyFile copies source to target verbatim, so compressed massifs stay
+// compressed, and encrypted files are not encrypted again by the store's
+// WriteOpener. As for writeAtomic, the copy is made to a temporary file,
+// which is synced and then linked to target, so a partial copy is never
+// exposed and an existing target is never replaced.
+func (s *CachingStore) copyFile(source, target string) (err error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	defer src.Close()
+
+	tmp := tempPath(target)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, s.Opts.FileCreateMode)
+	if err != nil {
+		return fmt.Errorf("failed to open temporary file %s for writing: %w", tmp, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err = errors.Join(err, f.Close()); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", source, tmp, err)
+	}
+
+	if err = os.Link(tmp, target); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %w", tmp, target, err)
+	}
+	if err = os.Remove(tmp); err != nil {
+		return fmt.Errorf("failed to remove temporary file %s: %w", tmp, err)
+	}
+	if err = syncDir(filepath.Dir(target)); err != nil {
+		return fmt.Errorf("failed to sync directory for %s: %w", target, err)
+	}
+	return nil
+}
+
+// sameContent returns whether the target exists, and if so whether it has the same content as the source
+func sameContent(source, target string) (bool, bool, error) {
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false, false, err
+	}
+	if os.SameFile(sourceInfo, targetInfo) {
+		return true, true, nil
+	}
+	if sourceInfo.Size() != targetInfo.Size() {
+		return true, false, nil
+	}
+	sourceSum, err := fileSHA256(source)
+	if err != nil {
+		return false, false, err
+	}
+	targetSum, err := fileSHA256(target)
+	if err != nil {
+		return false, false, err
+	}
+	return true, bytes.Equal(sourceSum, targetSum), nil
+}
+
+// fileSHA256 returns the SHA-256 digest of the file, as it is stored
+func fileSHA256(filePath string) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return h.Sum(nil), nil
+}
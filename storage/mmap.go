@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// isSealed returns true if the massif has a checkpoint and the log has moved
+// on to a later massif, so its content will never change again.
+func (s *CachingStore) isSealed(massifIndex uint32) bool {
+	paths, ok := s.Selected.MassifPaths[massifIndex]
+	return ok && paths.Data != "" && paths.Checkpoint != "" && massifIndex < s.Selected.HeadMassifIndex
+}
+
+// mapping is a read only memory mapping of a sealed massif. It is released
+// once the store has dropped it, see unmapMassif, and every MassifView of it
+// has been released.
+type mapping struct {
+	data []byte
+
+	mu      sync.Mutex
+	pins    int
+	dropped bool
+}
+
+// pin keeps the mapping until the returned function is called. The function
+// may be called from any goroutine, and more than once.
+func (m *mapping) pin() func() {
+	m.mu.Lock()
+	m.pins++
+	m.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.pins--
+			if m.pins == 0 && m.dropped {
+				_ = munmap(m.data)
+			}
+		})
+	}
+}
+
+// drop releases the mapping, or leaves that to the last pin released
+func (m *mapping) drop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped = true
+	if m.pins > 0 {
+		return nil
+	}
+	return munmap(m.data)
+}
+
+// mapMassif returns a read only memory mapping of the massif file, sharing
+// any existing mapping of the same file. It returns errors.ErrUnsupported if
+// the file can not be mapped, in which case the caller should read it instead.
+func (s *CachingStore) mapMassif(storagePath string) ([]byte, error) {
+	if m, ok := s.mappings[storagePath]; ok {
+		return m.data, nil
+	}
+	if !s.plainFiles() {
+		// The content is only the file content for the default opener
+		return nil, errors.ErrUnsupported
+	}
+
+	f, err := os.Open(storagePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, storagePath, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, errors.ErrUnsupported
+	}
+	data, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	// Mapped reads bypass read, so the whole massif is checked once, as it is mapped
+	if err := s.verifyChecksum(storagePath, data, true); err != nil {
+		return nil, errors.Join(err, munmap(data))
+	}
+	if err := s.verifyManifestEntry(storagePath, info, data); err != nil {
+		return nil, errors.Join(err, munmap(data))
+	}
+	s.recordVersion(storagePath, info, data, true)
+
+	if s.mappings == nil {
+		s.mappings = make(map[string]*mapping)
+	}
+	s.mappings[storagePath] = &mapping{data: data}
+	return data, nil
+}
+
+// unmapMassif releases the mapping of the file, if there is one. The massif
+// is first dropped from the cache of the log holding it, so no cached slice
+// refers to the released memory. The mapping is only returned to callers by
+// MassifView, which pins it, so it is kept until the last of those is
+// released.
+func (s *CachingStore) unmapMassif(storagePath string) error {
+	m, ok := s.mappings[storagePath]
+	if !ok {
+		return nil
+	}
+	delete(s.mappings, storagePath)
+	for logID, c := range s.Logs {
+		if _, ok := c.MassifData[storagePath]; ok {
+			s.logCacheDrop(logID, c, storagePath, cachedMassif)
+		}
+	}
+	if c := s.Selected; c != nil {
+		// a log being populated is not yet in Logs
+		if _, ok := c.MassifData[storagePath]; ok {
+			s.logCacheDrop(string(s.SelectedLogID), c, storagePath, cachedMassif)
+		}
+	}
+	return m.drop()
+}
+
+// unpinnedMassif returns cached massif data for a caller outside the store,
+// which may keep it indefinitely. Data cached as a mapping may be released
+// once the store's lock is released, so a full mapping is replaced in the
+// cache by a copy, once, and only the first n bytes of a partial one are
+// copied.
+func (s *CachingStore) unpinnedMassif(storagePath string, data []byte, n int) ([]byte, error) {
+	m, ok := s.mappings[storagePath]
+	if !ok {
+		return data, nil
+	}
+	if n >= 0 && n < len(m.data) {
+		return bytes.Clone(data[:n]), nil
+	}
+	data = bytes.Clone(m.data)
+	if err := s.unmapMassif(storagePath); err != nil {
+		return nil, fmt.Errorf("failed to release mapping of %s: %w", storagePath, err)
+	}
+	s.cacheMassif(storagePath, data)
+	return data, nil
+}
+
+// unmapAll releases every mapping held by the store
+func (s *CachingStore) unmapAll() error {
+	var errs []error
+	for storagePath := range s.mappings {
+		errs = append(errs, s.unmapMassif(storagePath))
+	}
+	return errors.Join(errs...)
+}
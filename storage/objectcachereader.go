@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"time"
 
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
@@ -13,32 +14,136 @@ import (
 // PopulateCache loads massif and checkpoint data for the currently selected log into the cache.
 // It initializes the Selected log cache if it does not exist, and populates the following fields:
 //   - MassifPaths: maps massif indices to their storage paths (data and checkpoint).
-//   - Starts: maps massif storage paths to their MassifStart metadata.
+//   - Starts: maps massif storage paths to their decoded MassifStart.
 //   - MassifData: maps storage paths to their raw data ([]byte for massifs, nil for checkpoints).
-//   - Checkpoints: maps checkpoint storage paths to their Checkpoint metadata.
+//   - Checkpoints: maps checkpoint storage paths to their decoded Checkpoint.
 //   - FirstMassifIndex, HeadMassifIndex: track the range of massif indices found.
 //   - FirstSealIndex, HeadSealIndex: track the range of seal (checkpoint) indices found.
 //
+// In lazy mode, the indices are taken from canonically named files without
+// opening them. The content is checked against the file name on first access.
+//
+// If a current manifest is available it is used instead of listing the
+// directories, and the objects are read lazily. Otherwise the manifest is
+// rebuilt after the directories have been scanned.
+//
+// If a recovery policy is configured, the recovery pass runs first. Files
+// with findings that were only reported are left out of the cache.
+//
+// Massif start headers and checkpoints are read concurrently, up to
+// PopulateConcurrency at a time, and merged into the cache in listing order.
+//
+// Missing massifs, duplicate massif indices and checkpoints without a massif
+// are reported by Health. If FailUnhealthy is set, any of them fail the
+// population with an *UnhealthyLogError.
+//
+// Unless the CorruptFiles policy is CorruptFileFail, files that can not be
+// loaded are left out of the cache, and are reported by CorruptFiles once
+// the remaining files have been loaded. The log is still usable.
+//
 // The method returns an error if the log is not selected, if directory listing fails for reasons
-// other than non-existence, or if reading any massif or checkpoint file fails.
+// other than non-existence, if reading any massif or checkpoint file fails, or if the context is done.
 func (s *CachingStore) PopulateCache(ctx context.Context) error {
 
 	if s.SelectedLogID == nil {
 		return storage.ErrLogNotSelected
 	}
+	// A new cache is only registered in Logs once it is populated, so that a
+	// failed population leaves nothing behind for activate to re-use.
+	key := string(s.SelectedLogID)
 	var ok bool
-	s.Selected, ok = s.Logs[string(s.SelectedLogID)]
+	s.Selected, ok = s.Logs[key]
 	if !ok {
 		s.Selected = &LogCache{
 			MassifPaths:      make(map[uint32]*MassifStoragePaths),
 			MassifData:       make(map[string][]byte),
 			CheckpointData:   make(map[string][]byte),
+			Starts:           make(map[string]*massifs.MassifStart),
+			Checkpoints:      make(map[string]*massifs.Checkpoint),
+			Versions:         make(map[string]VersionToken),
+			Unverified:       make(map[string]bool),
+			Evicted:          make(map[string]int),
+			MassifRanges:     make(map[string]*RangeCache),
+			Checksums:        make(map[string]CachedChecksum),
+			CheckedAt:        make(map[string]time.Time),
 			FirstMassifIndex: ^uint32(0),
 			FirstSealIndex:   ^uint32(0),
 		}
-		s.Logs[string(s.SelectedLogID)] = s.Selected
 	}
+	if err := s.populateCache(ctx); err != nil {
+		// Drop whatever was cached, including any earlier population of the log
+		s.Logs[key] = s.Selected
+		s.evictLog(key)
+		s.SelectedLogID = storage.LogID(key)
+		return err
+	}
+	s.Logs[key] = s.Selected
+	return nil
+}
+
+func (s *CachingStore) populateCache(ctx context.Context) error {
+	// Duplicates, and corrupt files, are noted as the objects are found
+	s.Selected.Health = LogHealth{}
+	s.Selected.CorruptFiles = nil
+
+	// Archives are read only, and can not be recovered
+	if s.Opts.RootDir != "" && s.Opts.Archive == nil && s.Opts.Recovery != RecoveryOff {
+		if _, err := s.Recover(ctx, s.Opts.Recovery); err != nil {
+			return fmt.Errorf("recovery failed for log %x: %w", s.SelectedLogID, err)
+		}
+	}
+
+	if s.Opts.RootDir != "" {
+		var err error
+		s.Selected.ListedAt = time.Now()
+		if s.Selected.MassifsMTime, s.Selected.SealsMTime, err = s.dirMTimes(); err != nil {
+			return err
+		}
+	}
+
+	var manifest *LogManifest
+	if s.manifestEnabled() {
+		var err error
+		if manifest, err = s.readManifest(); err != nil {
+			return err
+		}
+		ok, err := s.populateFromManifest(manifest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return s.checkHealth()
+		}
+	}
+
+	massifPaths, checkpointPaths, err := s.listObjectPaths()
+	if err != nil {
+		return err
+	}
+
+	if err := s.addObjectFiles(ctx, massifPaths, false); err != nil {
+		return err
+	}
+	if err := s.addObjectFiles(ctx, checkpointPaths, true); err != nil {
+		return err
+	}
+
+	if s.manifestEnabled() && len(s.Selected.MassifPaths) > 0 {
+		// Digests this store recorded, but could not yet save, are kept
+		previous := manifest
+		if s.Selected.Manifest != nil {
+			previous = s.Selected.Manifest
+		}
+		if err := s.rebuildManifest(previous); err != nil {
+			return fmt.Errorf("failed to rebuild manifest for log %x: %w", s.SelectedLogID, err)
+		}
+	}
+	return s.checkHealth()
+}
 
+// listObjectPaths lists the massif and checkpoint files for the selected log,
+// including any explicitly configured files.
+func (s *CachingStore) listObjectPaths() ([]string, []string, error) {
 	var massifPaths []string
 	var checkpointPaths []string
 
@@ -48,20 +153,20 @@ func (s *CachingStore) PopulateCache(ctx context.Context) error {
 		// Note: the explicit provision of MassifFilename only serves to locate the directory
 		massifsDir, err := s.PrefixPath(storage.ObjectMassifData)
 		if err != nil {
-			return fmt.Errorf("failed to get massif prefix for log %x: %w", s.SelectedLogID, err)
+			return nil, nil, fmt.Errorf("failed to get massif prefix for log %x: %w", s.SelectedLogID, err)
 		}
 		checkPointsDir, err := s.PrefixPath(storage.ObjectCheckpoint)
 		if err != nil {
-			return fmt.Errorf("failed to get checkpoint prefix for log %x: %w", s.SelectedLogID, err)
+			return nil, nil, fmt.Errorf("failed to get checkpoint prefix for log %x: %w", s.SelectedLogID, err)
 		}
 
-		massifPaths, err = NewSuffixDirLister(s.Opts.MassifExtension).ListFiles(massifsDir)
+		massifPaths, err = NewSuffixDirListerWith(s.Opts.DirLister, s.Opts.MassifExtension).ListFiles(massifsDir)
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("failed to list massif files in %s: %w", massifsDir, err)
+			return nil, nil, fmt.Errorf("failed to list massif files in %s: %w", massifsDir, err)
 		}
-		checkpointPaths, err = NewSuffixDirLister(s.Opts.SealExtension).ListFiles(checkPointsDir)
+		checkpointPaths, err = NewSuffixDirListerWith(s.Opts.DirLister, s.Opts.SealExtension).ListFiles(checkPointsDir)
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("failed to list checkpoint files in %s: %w", checkPointsDir, err)
+			return nil, nil, fmt.Errorf("failed to list checkpoint files in %s: %w", checkPointsDir, err)
 		}
 	}
 
@@ -72,56 +177,110 @@ func (s *CachingStore) PopulateCache(ctx context.Context) error {
 	if s.Opts.CheckpointFile != "" {
 		checkpointPaths = append(checkpointPaths, s.Opts.CheckpointFile)
 	}
+	return massifPaths, checkpointPaths, nil
+}
 
-	for _, storagePath := range massifPaths {
-
-		start, data, err := s.readStart(storagePath)
-		if err != nil {
-			return fmt.Errorf("failed to read massif start from %s: %w", storagePath, err)
-		}
-		s.Selected.MassifPaths[start.MassifIndex] = &MassifStoragePaths{
-			Data: storagePath,
+// addMassifFile adds a single massif file to the selected log cache
+func (s *CachingStore) addMassifFile(storagePath string) (uint32, error) {
+	if s.Opts.LazySelect {
+		if massifIndex, ok := IndexFromPath(storagePath, s.Opts.MassifExtension); ok {
+			s.Selected.Unverified[storagePath] = true
+			s.addMassifPath(massifIndex, storagePath)
+			return massifIndex, nil
 		}
+	}
+	l, err := s.loadMassifStart(storagePath)
+	if err != nil {
+		return 0, err
+	}
+	s.mergeMassifStart(l)
+	return l.massifIndex, nil
+}
 
-		s.Selected.MassifData[storagePath] = data
-
-		if start.MassifIndex < s.Selected.FirstMassifIndex {
-			s.Selected.FirstMassifIndex = start.MassifIndex
-		}
-		if start.MassifIndex > s.Selected.HeadMassifIndex {
-			s.Selected.HeadMassifIndex = start.MassifIndex
+// addCheckpointFile adds a single checkpoint file to the selected log cache
+func (s *CachingStore) addCheckpointFile(storagePath string) (uint32, error) {
+	if s.Opts.LazySelect {
+		if massifIndex, ok := IndexFromPath(storagePath, s.Opts.SealExtension); ok {
+			s.Selected.Unverified[storagePath] = true
+			s.addCheckpointPath(massifIndex, storagePath)
+			return massifIndex, nil
 		}
 	}
-	for _, storagePath := range checkpointPaths {
-		// Pre-populate the massif data map with empty data to indicate presence
+	l, err := s.loadCheckpoint(storagePath)
+	if err != nil {
+		return 0, err
+	}
+	s.mergeCheckpoint(l)
+	return l.massifIndex, nil
+}
 
-		checkpt, data, err := s.readCheckpoint(storagePath)
-		if err != nil {
-			return fmt.Errorf("failed to read checkpoint from %s: %w", storagePath, err)
-		}
-		massifIndex := uint32(massifs.MassifIndexFromMMRIndex(s.Opts.StorageOptions.MassifHeight, checkpt.MMRState.MMRSize-1))
+// addMassifPath records the massif data path for the index and updates the range of known massif indices.
+func (s *CachingStore) addMassifPath(massifIndex uint32, storagePath string) {
+	paths, ok := s.Selected.MassifPaths[massifIndex]
+	if !ok {
+		paths = &MassifStoragePaths{}
+		s.Selected.MassifPaths[massifIndex] = paths
+	}
+	if paths.Data != "" && paths.Data != storagePath {
+		s.noteDuplicate(massifIndex, storage.ObjectMassifData, paths.Data, storagePath)
+	}
+	paths.Data = storagePath
 
-		s.Selected.CheckpointData[storagePath] = data
+	if massifIndex < s.Selected.FirstMassifIndex {
+		s.Selected.FirstMassifIndex = massifIndex
+	}
+	if massifIndex > s.Selected.HeadMassifIndex {
+		s.Selected.HeadMassifIndex = massifIndex
+	}
+}
 
-		// if we also have the massif path, keep the massif and checkpoint paths together
-		var paths *MassifStoragePaths
-		var ok bool
-		if paths, ok = s.Selected.MassifPaths[massifIndex]; !ok {
-			paths = &MassifStoragePaths{}
-			s.Selected.MassifPaths[massifIndex] = paths
-		}
+// addCheckpointPath records the checkpoint path for the index and updates the range of known seal indices.
+func (s *CachingStore) addCheckpointPath(massifIndex uint32, storagePath string) {
+	// if we also have the massif path, keep the massif and checkpoint paths together
+	paths, ok := s.Selected.MassifPaths[massifIndex]
+	if !ok {
+		paths = &MassifStoragePaths{}
+		s.Selected.MassifPaths[massifIndex] = paths
+	}
+	if paths.Checkpoint != "" && paths.Checkpoint != storagePath {
+		s.noteDuplicate(massifIndex, storage.ObjectCheckpoint, paths.Checkpoint, storagePath)
+	}
+	paths.Checkpoint = storagePath
 
-		paths.Checkpoint = storagePath
+	// update the range of known seal indices, which may be disjoint from the massif indices
+	if massifIndex < s.Selected.FirstSealIndex {
+		s.Selected.FirstSealIndex = massifIndex
+	}
+	if massifIndex > s.Selected.HeadSealIndex {
+		s.Selected.HeadSealIndex = massifIndex
+	}
+}
 
-		// update the range of known seal indices, which may be disjoint from the massif indices
-		if massifIndex < s.Selected.FirstSealIndex {
-			s.Selected.FirstSealIndex = massifIndex
+// removePath forgets a massif or checkpoint path, and recomputes the ranges of known indices
+func (s *CachingStore) removePath(storagePath string) {
+	c := s.Selected
+	c.FirstMassifIndex, c.HeadMassifIndex = ^uint32(0), 0
+	c.FirstSealIndex, c.HeadSealIndex = ^uint32(0), 0
+	for massifIndex, paths := range c.MassifPaths {
+		if paths.Data == storagePath {
+			paths.Data = ""
 		}
-		if massifIndex > s.Selected.HeadSealIndex {
-			s.Selected.HeadSealIndex = massifIndex
+		if paths.Checkpoint == storagePath {
+			paths.Checkpoint = ""
+		}
+		if paths.Data == "" && paths.Checkpoint == "" {
+			delete(c.MassifPaths, massifIndex)
+			continue
+		}
+		if paths.Data != "" {
+			c.FirstMassifIndex = min(c.FirstMassifIndex, massifIndex)
+			c.HeadMassifIndex = max(c.HeadMassifIndex, massifIndex)
+		}
+		if paths.Checkpoint != "" {
+			c.FirstSealIndex = min(c.FirstSealIndex, massifIndex)
+			c.HeadSealIndex = max(c.HeadSealIndex, massifIndex)
 		}
 	}
-	return nil
 }
 
 // readStart reads and decodes the MassifStart header from the given storage path.
@@ -2,8 +2,10 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
@@ -20,6 +22,9 @@ func (s *CachingStore) HeadIndex(ctx context.Context, otype storage.ObjectType)
 	if c == nil {
 		return 0, storage.ErrLogNotSelected
 	}
+	if err := s.refreshDirsIfStale(); err != nil {
+		return 0, err
+	}
 
 	switch otype {
 	case storage.ObjectMassifData, storage.ObjectMassifStart:
@@ -33,6 +38,9 @@ func (s *CachingStore) HeadIndex(ctx context.Context, otype storage.ObjectType)
 
 func (s *CachingStore) MassifData(massifIndex uint32) ([]byte, bool, error) {
 
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, false, err
+	}
 	storagePath, ok, err := s.dataPath(massifIndex)
 	if err != nil {
 		return nil, false, err
@@ -41,12 +49,46 @@ func (s *CachingStore) MassifData(massifIndex uint32) ([]byte, bool, error) {
 		// The path is discovered (or not) by PopulateCache given the configured directories.
 		return nil, false, storage.ErrDoesNotExist
 	}
+	if err := s.refreshFileIfStale(storagePath); err != nil {
+		return nil, false, err
+	}
 	data, ok := s.Selected.MassifData[storagePath]
-	return data, ok, nil
+	if ok {
+		s.cacheTouch(storagePath, cachedMassif)
+		data, err = s.unpinnedMassif(storagePath, data, len(data))
+		return data, err == nil, err
+	}
+
+	// Re-read evicted data to the length that was cached, or in full if n is
+	// negative. Lazily discovered massifs get the start header, as
+	// PopulateCache would have read.
+	n, evicted := s.Selected.Evicted[storagePath]
+	if !evicted && !s.Selected.Unverified[storagePath] {
+		return nil, false, nil
+	}
+	if !evicted {
+		n = massifs.StartHeaderSize
+	}
+	if n < 0 {
+		data, err = s.read(storagePath)
+	} else {
+		data, err = s.readn(storagePath, n)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err = s.verifyOnAccess(massifIndex, storagePath, storage.ObjectMassifStart, data); err != nil {
+		return nil, false, err
+	}
+	s.cacheMassif(storagePath, data)
+	return data, true, nil
 }
 
 func (s *CachingStore) CheckpointData(massifIndex uint32) ([]byte, bool, error) {
 
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, false, err
+	}
 	storagePath, ok, err := s.checkpointPath(massifIndex)
 	if err != nil {
 		return nil, false, err
@@ -55,39 +97,119 @@ func (s *CachingStore) CheckpointData(massifIndex uint32) ([]byte, bool, error)
 		// The path is discovered (or not) by PopulateCache given the configured directories.
 		return nil, false, fmt.Errorf("%w: checkpoint for massif %d not found", storage.ErrDoesNotExist, massifIndex)
 	}
+	if err := s.refreshFileIfStale(storagePath); err != nil {
+		return nil, false, err
+	}
 
 	data, ok := s.Selected.CheckpointData[storagePath]
-	return data, ok, nil
+	if ok {
+		s.cacheTouch(storagePath, cachedCheckpoint)
+		return data, ok, nil
+	}
+
+	// Re-read evicted or lazily discovered checkpoints in full
+	if _, evicted := s.Selected.Evicted[storagePath]; !evicted && !s.Selected.Unverified[storagePath] {
+		return nil, false, nil
+	}
+	if data, err = s.CheckpointRead(context.Background(), massifIndex); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
 }
 
 // MassifReadN un-conditionally reads up to n bytes of the massif data The read
 // data is both cached and returned. Subsequent calls to MassifData will return
 // the cached data.
+//
+// If MmapSealed is set, sealed massifs are memory mapped rather than read,
+// unless the whole massif is read and it is not already mapped. The mapping
+// is what is cached. The mapping is released when the massif is evicted or
+// rewritten, or the store is closed, so only the bytes read are copied for
+// the caller. A whole massif replaces the mapping in the cache with a copy,
+// see unpinnedMassif, and MassifView returns the mapping itself. Compressed
+// massifs are always read.
 func (s *CachingStore) MassifReadN(ctx context.Context, massifIndex uint32, n int) ([]byte, error) {
+	data, storagePath, err := s.massifReadN(massifIndex, n, n >= 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.unpinnedMassif(storagePath, data, n)
+}
+
+// MassifView returns the whole massif data without copying it. If the
+// massif is memory mapped, see MmapSealed, the data is the mapping, which is
+// kept until release is called, even if the massif is evicted or rewritten,
+// or the store is closed. Otherwise the massif is read, as by MassifReadN.
+// The data must not be modified, nor used once release has been called.
+func (s *CachingStore) MassifView(ctx context.Context, massifIndex uint32) ([]byte, func(), error) {
+	data, storagePath, err := s.massifReadN(massifIndex, -1, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m, ok := s.mappings[storagePath]; ok {
+		return data, m.pin(), nil
+	}
+	return data, func() {}, nil
+}
+
+// massifReadN reads up to n bytes of the massif data, and caches them. If
+// mapSealed is set, or the massif is already mapped, and MmapSealed applies,
+// the result is the mapping.
+func (s *CachingStore) massifReadN(massifIndex uint32, n int, mapSealed bool) ([]byte, string, error) {
 
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, "", err
+	}
 	storagePath, ok, err := s.dataPath(massifIndex)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if !ok {
 		// The path is discovered (or not) by PopulateCache given the configured directories.
-		return nil, storage.ErrDoesNotExist
+		return nil, "", storage.ErrDoesNotExist
 	}
 
 	var data []byte
-	if n < 0 {
-		data, err = s.read(storagePath)
-	} else {
-		data, err = s.readn(storagePath, n)
+	mapped := false
+	_, isMapped := s.mappings[storagePath]
+	if (mapSealed || isMapped) && s.Opts.MmapSealed && s.Opts.Archive == nil &&
+		s.isSealed(massifIndex) && !IsCompressed(storagePath) {
+		data, err = s.mapMassif(storagePath)
+		switch {
+		case err == nil:
+			mapped = true
+			if n >= 0 && n < len(data) {
+				data = data[:n]
+			}
+		case !errors.Is(err, errors.ErrUnsupported):
+			return nil, "", err
+		}
 	}
-	if err != nil {
-		return nil, err
+	if !mapped {
+		// the read replaces any mapping in the cache
+		if err := s.unmapMassif(storagePath); err != nil {
+			return nil, "", fmt.Errorf("failed to release mapping of %s: %w", storagePath, err)
+		}
+		if n < 0 {
+			data, err = s.read(storagePath)
+		} else {
+			data, err = s.readn(storagePath, n)
+		}
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	s.Selected.MassifData[storagePath] = data
-	return data, nil
+	if err = s.verifyOnAccess(massifIndex, storagePath, storage.ObjectMassifData, data); err != nil {
+		return nil, "", err
+	}
+	s.cacheMassif(storagePath, data)
+	return data, storagePath, nil
 }
 
 func (s *CachingStore) CheckpointRead(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, err
+	}
 	storagePath, ok, err := s.checkpointPath(massifIndex)
 	if err != nil {
 		return nil, err
@@ -101,40 +223,72 @@ func (s *CachingStore) CheckpointRead(ctx context.Context, massifIndex uint32) (
 	if err != nil {
 		return nil, err
 	}
-	s.Selected.CheckpointData[storagePath] = data
+	if err = s.verifyOnAccess(massifIndex, storagePath, storage.ObjectCheckpoint, data); err != nil {
+		return nil, err
+	}
+	s.cacheCheckpoint(storagePath, data)
 	return data, nil
 }
 
 func (s *CachingStore) readn(filePath string, n int) ([]byte, error) {
+	data, info, err := s.readnFile(filePath, n)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyPartialChecksum(filePath, info, data); err != nil {
+		return nil, err
+	}
+	s.recordVersion(filePath, info, data, false)
+	return data, nil
+}
 
-	file, err := s.Opts.ReadOpener.Open(filePath)
+func (s *CachingStore) read(storagePath string) ([]byte, error) {
+	data, info, err := s.readFile(storagePath)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, filePath, err)
+		return nil, err
+	}
+	if err := s.verifyChecksum(storagePath, data, true); err != nil {
+		return nil, err
+	}
+	if err := s.verifyManifestEntry(storagePath, info, data); err != nil {
+		return nil, err
+	}
+	s.recordVersion(storagePath, info, data, true)
+	return data, nil
+}
+
+// readnFile reads n bytes from the file, returning its FileInfo if the opener provides it.
+// It does not modify the store, and is safe to call concurrently.
+func (s *CachingStore) readnFile(filePath string, n int) ([]byte, fs.FileInfo, error) {
+
+	file, err := s.openObject(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, filePath, err)
 	}
 	defer file.Close()
 
+	// A single read may return less than is available, notably for archive
+	// members, and for decompressing or decrypting readers
 	data := make([]byte, n)
-	_, err = file.Read(data)
-	if err != nil || len(data) != n {
-		if err == nil {
-			return nil, fmt.Errorf("%w: failed to read %d bytes from file %s", storage.ErrDoesNotExist, n, filePath)
-		}
-		return nil, fmt.Errorf("%w: failed to read  file %s (%v)", storage.ErrDoesNotExist, filePath, err)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to read %d bytes from file %s (%w)", storage.ErrDoesNotExist, n, filePath, err)
 	}
-	return data, nil
+	return data, fileInfo(file), nil
 }
 
-func (s *CachingStore) read(storagePath string) ([]byte, error) {
+// readFile reads the whole file, returning its FileInfo if the opener provides it.
+// It does not modify the store, and is safe to call concurrently.
+func (s *CachingStore) readFile(storagePath string) ([]byte, fs.FileInfo, error) {
 
-	file, err := s.Opts.ReadOpener.Open(storagePath)
+	file, err := s.openObject(storagePath)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, storagePath, err)
+		return nil, nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, storagePath, err)
 	}
 	defer file.Close()
 
 	data, err := io.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from %s: %w", storagePath, err)
+		return nil, nil, fmt.Errorf("failed to read from %s: %w", storagePath, err)
 	}
-	return data, nil
+	return data, fileInfo(file), nil
 }
@@ -2,8 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 
@@ -13,8 +14,10 @@ import (
 func (s *CachingStore) HasCapability(feature storage.StorageFeature) bool {
 	switch feature {
 	case storage.OptimisticWrite:
-		// assuming there is only a single writer per log
-		return true
+		// Put refuses to replace an object that changed on disk since this
+		// store last read or wrote it, checking under the writer lock, see
+		// checkVersion and lockForPut.
+		return s.Opts.Archive == nil
 	default:
 		return false
 	}
@@ -28,9 +31,16 @@ func (s *CachingStore) Put(
 	if s.Selected == nil {
 		return storage.ErrLogNotSelected
 	}
+	if s.Opts.Archive != nil {
+		return ErrReadOnly
+	}
+	unlock, err := s.lockForPut(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	var storagePath string
-	var err error
 
 	prefix, err := s.PrefixPath(ty)
 	if err != nil {
@@ -41,24 +51,52 @@ func (s *CachingStore) Put(
 	if err != nil {
 		return fmt.Errorf("failed to get storage path for massif index %d, type %v: %w", massifIndex, ty, err)
 	}
+	// Taken before anything in the log directory changes, see updateManifest
+	manifestCurrent, err := s.manifestCurrent()
+	if err != nil {
+		return err
+	}
+
 	dir := filepath.Dir(storagePath)
 	if err := os.MkdirAll(dir, s.Opts.DirCreateMode); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 
-	var f io.WriteCloser
-	if failIfExists {
-		f, err = s.Opts.WriteOpener.OpenCreate(storagePath)
-	} else {
-		f, err = s.Opts.WriteOpener.OpenWrite(storagePath)
+	if err := s.unmapMassif(storagePath); err != nil {
+		return fmt.Errorf("failed to release mapping of %s: %w", storagePath, err)
 	}
-	if err != nil {
-		return fmt.Errorf("failed to open storage path %s for writing: %w", storagePath, err)
+
+	if !failIfExists {
+		if err := s.checkVersion(storagePath); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
 
-	if _, err := f.Write(data); err != nil {
-		return fmt.Errorf("failed to write data to storage path %s: %w", storagePath, err)
+	// The sidecar is removed before the object changes, and written after.
+	// An object which already exists fails an exclusive write below, and
+	// keeps its sidecar.
+	if _, statErr := os.Lstat(storagePath); !failIfExists || errors.Is(statErr, fs.ErrNotExist) {
+		if err := s.removeChecksum(storagePath); err != nil {
+			return err
+		}
+	}
+
+	appended := false
+	if !failIfExists && ty == storage.ObjectMassifData {
+		if appended, err = s.tryAppend(storagePath, data); err != nil {
+			return err
+		}
+	}
+	if !appended {
+		if err := s.writeAtomic(storagePath, data, failIfExists); err != nil {
+			return err
+		}
+	}
+	if err := s.recordWrittenVersion(storagePath, data); err != nil {
+		return err
+	}
+	if err := s.writeChecksum(massifIndex, storagePath, data); err != nil {
+		return err
 	}
 
 	paths, ok := s.Selected.MassifPaths[massifIndex]
@@ -68,7 +106,7 @@ func (s *CachingStore) Put(
 
 	switch ty {
 	case storage.ObjectMassifData, storage.ObjectMassifStart:
-		s.Selected.MassifData[storagePath] = data
+		s.cacheMassif(storagePath, data)
 
 		if massifIndex > s.Selected.HeadMassifIndex {
 			s.Selected.HeadMassifIndex = massifIndex
@@ -80,7 +118,7 @@ func (s *CachingStore) Put(
 
 	case storage.ObjectCheckpoint:
 
-		s.Selected.CheckpointData[storagePath] = data
+		s.cacheCheckpoint(storagePath, data)
 		if massifIndex > s.Selected.HeadSealIndex {
 			s.Selected.HeadSealIndex = massifIndex
 		}
@@ -94,5 +132,8 @@ func (s *CachingStore) Put(
 	}
 	s.Selected.MassifPaths[massifIndex] = paths
 
-	return nil
+	if err := s.updateManifest(massifIndex, ty, storagePath, data, manifestCurrent); err != nil {
+		return err
+	}
+	return s.compressIfSealed(massifIndex, ty)
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"os"
+	"time"
 
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
@@ -28,9 +29,57 @@ type FSOptions struct {
 	SealExtension   string // e.g. ".sth"
 	MassifExtension string // e.g. ".log"
 	ReadOpener      Opener
+	DirLister       DirLister
+	PrefixProvider  PrefixProvider
 	WriteOpener     WriteOpener
 	FileCreateMode  os.FileMode
 	DirCreateMode   os.FileMode
+	// WriterLock selects when the advisory per log writer lock is taken
+	WriterLock WriterLockMode
+	// WriterLockNoWait fails immediately, rather than waiting, if the writer lock is held elsewhere
+	WriterLockNoWait bool
+	// Recovery selects how the recovery pass run by PopulateCache deals with torn and orphaned files
+	Recovery RecoveryPolicy
+	// LazySelect takes massif and seal indices from file names when a log is
+	// selected, deferring all reads until the objects are accessed.
+	LazySelect bool
+	// UseManifest maintains a persistent index of each log directory, which
+	// is used to select the log without listing or reading its objects.
+	UseManifest bool
+	// CacheBudget bounds the object bytes cached across all logs. The least
+	// recently used objects are evicted when it is exceeded. Zero means unbounded.
+	CacheBudget int64
+	// MmapSealed memory maps sealed massifs, rather than reading them into
+	// memory. MassifView returns the mapped data, other reads copy only the
+	// bytes they return, see MassifReadN.
+	MmapSealed bool
+	// StaleCheckInterval enables checks for changes made by other writers
+	// when the cache is accessed. The log directories, and each cached
+	// object, are checked at most once per interval. Zero disables the checks.
+	StaleCheckInterval time.Duration
+	// OnRefresh, if set, is called when a stale check or Refresh finds changes
+	OnRefresh func(RefreshEvent)
+	// PopulateConcurrency bounds the files read concurrently when a log is selected
+	PopulateConcurrency int
+	// FailUnhealthy fails selection of logs with missing massifs, duplicate
+	// massif indices or checkpoints without a massif.
+	FailUnhealthy bool
+	// CorruptFiles selects whether files that can not be loaded fail
+	// PopulateCache, or are left out and reported.
+	CorruptFiles CorruptFilePolicy
+	// CompressSealed stores each massif gzip compressed once it is sealed,
+	// that is once it has a checkpoint and the log has a later massif
+	CompressSealed bool
+	// Archive serves the store, read only, from a tar or zip archive. It is
+	// opened automatically if RootDir is an archive file.
+	Archive *Archive
+	// Checksums writes a checksum sidecar for each object put, and checks
+	// objects against their sidecars when they are read.
+	Checksums bool
+	// Keys, if set, encrypts the files of each log at rest with its data key.
+	// The read and write openers are wrapped by EncryptingOpener and
+	// EncryptingWriteOpener.
+	Keys KeyProvider
 }
 
 type Options struct {
@@ -50,6 +99,14 @@ func WithRootDir(dir string) massifs.Option {
 	}
 }
 
+func WithPrefixProvider(provider PrefixProvider) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.PrefixProvider = provider
+		}
+	}
+}
+
 func WithCreateRootDir() massifs.Option {
 	return func(a any) {
 		if o, ok := a.(*Options); ok {
@@ -74,6 +131,112 @@ func WithCheckpointFile(fileName string) massifs.Option {
 	}
 }
 
+func WithWriterLock(mode WriterLockMode, noWait bool) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.WriterLock = mode
+			o.WriterLockNoWait = noWait
+		}
+	}
+}
+
+func WithRecovery(policy RecoveryPolicy) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.Recovery = policy
+		}
+	}
+}
+
+func WithLazySelect() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.LazySelect = true
+		}
+	}
+}
+
+func WithManifest() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.UseManifest = true
+		}
+	}
+}
+
+func WithCacheBudget(bytes int64) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.CacheBudget = bytes
+		}
+	}
+}
+
+func WithMmapSealed() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.MmapSealed = true
+		}
+	}
+}
+
+func WithStaleCheck(interval time.Duration, onRefresh func(RefreshEvent)) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.StaleCheckInterval = interval
+			o.OnRefresh = onRefresh
+		}
+	}
+}
+
+func WithFailUnhealthy() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.FailUnhealthy = true
+		}
+	}
+}
+
+func WithCorruptFilePolicy(policy CorruptFilePolicy) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.CorruptFiles = policy
+		}
+	}
+}
+
+func WithCompressSealed() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.CompressSealed = true
+		}
+	}
+}
+
+func WithChecksums() massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.Checksums = true
+		}
+	}
+}
+
+func WithEncryption(keys KeyProvider) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.Keys = keys
+		}
+	}
+}
+
+func WithArchive(archive *Archive) massifs.Option {
+	return func(a any) {
+		if o, ok := a.(*Options); ok {
+			o.Archive = archive
+		}
+	}
+}
+
 func (opts *Options) FillDefaults() error {
 	var err error
 
@@ -104,16 +267,22 @@ func (opts *Options) FillDefaults() error {
 		opts.DirCreateMode = 0755
 	}
 
-	// if opts.PrefixProvider == nil {
-	// 	return nil, fmt.Errorf("a prefix provider is required")
-	// }
+	if opts.PrefixProvider == nil {
+		opts.PrefixProvider = NewPrefixProvider()
+	}
 
 	if opts.MassifExtension == "" {
 		opts.MassifExtension = DefaultMassifExt
 	}
+	if opts.PopulateConcurrency == 0 {
+		opts.PopulateConcurrency = DefaultPopulateConcurrency
+	}
 	if opts.ReadOpener == nil {
 		opts.ReadOpener = NewFileOpener()
 	}
+	if opts.DirLister == nil {
+		opts.DirLister = NewDirLister()
+	}
 	if opts.WriteOpener == nil {
 		opts.WriteOpener = NewDefaultWriteOpener(opts.FileCreateMode)
 	}
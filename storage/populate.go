@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/forestrie/go-merklelog/massifs"
+)
+
+const (
+	DefaultPopulateConcurrency = 8
+)
+
+// loadedObject is the result of reading and decoding a massif start header, or a checkpoint
+type loadedObject struct {
+	path        string
+	massifIndex uint32
+	data        []byte
+	info        fs.FileInfo
+	start       *massifs.MassifStart
+	checkpt     *massifs.Checkpoint
+	// err is set, instead of failing the load, if corrupt files are tolerated
+	err error
+}
+
+// loadMassifStart reads and decodes the start header of a massif file. It
+// does not modify the store, and is safe to call concurrently.
+func (s *CachingStore) loadMassifStart(storagePath string) (loadedObject, error) {
+	data, info, err := s.readnFile(storagePath, massifs.StartHeaderSize)
+	if err != nil {
+		return loadedObject{}, fmt.Errorf("failed to read massif start from %s: %w", storagePath, err)
+	}
+	start, err := decodeStart(data)
+	if err != nil {
+		return loadedObject{}, fmt.Errorf("failed to decode massif start from %s: %w", storagePath, err)
+	}
+	return loadedObject{path: storagePath, massifIndex: start.MassifIndex, data: data, info: info, start: start}, nil
+}
+
+// loadCheckpoint reads and decodes a checkpoint file. It does not modify the
+// store, and is safe to call concurrently.
+func (s *CachingStore) loadCheckpoint(storagePath string) (loadedObject, error) {
+	data, info, err := s.readFile(storagePath)
+	if err != nil {
+		return loadedObject{}, fmt.Errorf("failed to read checkpoint from %s: %w", storagePath, err)
+	}
+	if err := s.verifyChecksum(storagePath, data, true); err != nil {
+		return loadedObject{}, err
+	}
+	checkpt, err := decodeCheckpoint(*s.Opts.StorageOptions.CBORCodec, data)
+	if err != nil {
+		return loadedObject{}, fmt.Errorf("failed to decode checkpoint from %s: %w", storagePath, err)
+	}
+	massifIndex := uint32(massifs.MassifIndexFromMMRIndex(s.Opts.StorageOptions.MassifHeight, checkpt.MMRState.MMRSize-1))
+	return loadedObject{path: storagePath, massifIndex: massifIndex, data: data, info: info, checkpt: checkpt}, nil
+}
+
+func (s *CachingStore) mergeMassifStart(l loadedObject) {
+	s.recordVersion(l.path, l.info, l.data, false)
+	s.cacheMassif(l.path, l.data)
+	s.Selected.Starts[l.path] = l.start
+	s.addMassifPath(l.massifIndex, l.path)
+}
+
+func (s *CachingStore) mergeCheckpoint(l loadedObject) {
+	s.recordVersion(l.path, l.info, l.data, true)
+	s.cacheCheckpoint(l.path, l.data)
+	s.Selected.Checkpoints[l.path] = l.checkpt
+	s.addCheckpointPath(l.massifIndex, l.path)
+}
+
+// addObjectFiles adds massif or checkpoint files to the selected log cache.
+// Files whose indices are taken from their names in lazy mode are added
+// directly. The remainder are loaded concurrently, bounded by
+// PopulateConcurrency, and then merged in the order given. If the context
+// is cancelled, the loading stops and nothing is merged. Files that can not
+// be loaded are left out according to the CorruptFiles policy.
+func (s *CachingStore) addObjectFiles(ctx context.Context, storagePaths []string, checkpoints bool) error {
+	ext := s.Opts.MassifExtension
+	load, merge := s.loadMassifStart, s.mergeMassifStart
+	addPath := s.addMassifPath
+	if checkpoints {
+		ext = s.Opts.SealExtension
+		load, merge = s.loadCheckpoint, s.mergeCheckpoint
+		addPath = s.addCheckpointPath
+	}
+
+	var pending []string
+	for _, storagePath := range storagePaths {
+		if s.Selected.Excluded[storagePath] {
+			continue
+		}
+		if s.Opts.LazySelect {
+			if _, ok := IndexFromPath(storagePath, ext); ok {
+				continue
+			}
+		}
+		pending = append(pending, storagePath)
+	}
+
+	loaded, err := loadConcurrently(ctx, pending, s.Opts.PopulateConcurrency, s.tolerantLoad(load))
+	if err != nil {
+		return err
+	}
+
+	next := 0
+	for _, storagePath := range storagePaths {
+		if next < len(loaded) && loaded[next].path == storagePath {
+			l := loaded[next]
+			next++
+			if l.err != nil {
+				if err := s.leaveOut(ctx, storagePath, l.err); err != nil {
+					return err
+				}
+				continue
+			}
+			merge(l)
+			continue
+		}
+		if s.Selected.Excluded[storagePath] {
+			continue
+		}
+		massifIndex, _ := IndexFromPath(storagePath, ext)
+		s.Selected.Unverified[storagePath] = true
+		addPath(massifIndex, storagePath)
+	}
+	return nil
+}
+
+// loadConcurrently applies load to each path using at most limit goroutines.
+// The results are in the same order as the paths. If any load fails, the
+// error for the earliest such path is returned. Loading stops early if a
+// load fails, or if the context is done.
+func loadConcurrently(
+	parent context.Context, storagePaths []string, limit int,
+	load func(string) (loadedObject, error),
+) ([]loadedObject, error) {
+
+	if limit < 1 {
+		limit = 1
+	}
+	results := make([]loadedObject, len(storagePaths))
+	errs := make([]error, len(storagePaths))
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+dispatch:
+	for i, storagePath := range storagePaths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			results[i], errs[i] = load(storagePath)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
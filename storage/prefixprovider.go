@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"encoding/hex"
 	"fmt"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/forestrie/go-merklelog/massifs/storage"
 	"github.com/google/uuid"
@@ -15,25 +18,113 @@ const (
 	DatatrailsLogIDParsePrefix = DatatrailsLogIDPrefix + "/"
 	CheckpointsDirName         = "checkpoints"
 	MassifsDirName             = "massifs"
+	DatatrailsBlobPrefix       = "v1/mmrs"
+	DatatrailsBlobEpoch        = "0"
+	DatatrailsSealsDirName     = "massifseals"
+
+	// uuidStringLen is the length of the canonical uuid string form
+	uuidStringLen = 36
 )
 
-func (s CachingStore) PrefixPath(otype storage.ObjectType) (string, error) {
-	switch otype {
-	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
+// PrefixProvider determines the on disk layout of the logs under the root dir.
+// A log directory holds all objects for a single log, it is found at
+// <root>/<LogsDir>/<LogDirName>. The objects of each type are in a fixed
+// sub directory of the log directory.
+type PrefixProvider interface {
+	// LogsDir returns the directory, relative to the root dir, containing the log directories
+	LogsDir() string
+	// LogDirName returns the name of the log directory for the log id
+	LogDirName(logID storage.LogID) (string, error)
+	// ParseLogDirName returns the log id for a log directory name, it is the inverse of LogDirName
+	ParseLogDirName(name string) (storage.LogID, error)
+	// ObjectDir returns the directory, relative to the log directory, for objects of the type
+	ObjectDir(otype storage.ObjectType) (string, error)
+}
 
-		// Use the logid and stick to the 'tenant/UUID' organization established by datatrails.
-		return filepath.Join(s.Opts.RootDir, LogIDPrefix, uuid.UUID(s.SelectedLogID).String(), MassifsDirName) + "/", nil
+// LayoutPrefixProvider is a PrefixProvider for layouts which name each log
+// directory using LogID2DirName.
+type LayoutPrefixProvider struct {
+	LogsDirPath    string
+	MassifsDir     string
+	CheckpointsDir string
+}
 
-	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
+// NewPrefixProvider returns the neutral layout, <root>/log/<uuid>/{massifs,checkpoints}/
+func NewPrefixProvider() PrefixProvider {
+	return &LayoutPrefixProvider{
+		LogsDirPath:    LogIDPrefix,
+		MassifsDir:     MassifsDirName,
+		CheckpointsDir: CheckpointsDirName,
+	}
+}
+
+// NewDatatrailsPrefixProvider returns the datatrails tenant layout, <root>/tenant/<uuid>/{massifs,checkpoints}/
+func NewDatatrailsPrefixProvider() PrefixProvider {
+	return &LayoutPrefixProvider{
+		LogsDirPath:    DatatrailsLogIDPrefix,
+		MassifsDir:     MassifsDirName,
+		CheckpointsDir: CheckpointsDirName,
+	}
+}
+
+// NewDatatrailsBlobPrefixProvider returns the exact layout of the datatrails
+// blob store, <root>/v1/mmrs/tenant/<uuid>/0/{massifs,massifseals}/
+func NewDatatrailsBlobPrefixProvider() PrefixProvider {
+	return &LayoutPrefixProvider{
+		LogsDirPath:    path.Join(DatatrailsBlobPrefix, DatatrailsLogIDPrefix),
+		MassifsDir:     path.Join(DatatrailsBlobEpoch, MassifsDirName),
+		CheckpointsDir: path.Join(DatatrailsBlobEpoch, DatatrailsSealsDirName),
+	}
+}
+
+func (p *LayoutPrefixProvider) LogsDir() string {
+	return p.LogsDirPath
+}
 
-		// Otherwise the logid and stick to the 'tenant/UUID' organization established by datatrails.
-		return filepath.Join(s.Opts.RootDir, LogIDPrefix, uuid.UUID(s.SelectedLogID).String(), CheckpointsDirName) + "/", nil
+func (p *LayoutPrefixProvider) LogDirName(logID storage.LogID) (string, error) {
+	return LogID2DirName(logID)
+}
 
+func (p *LayoutPrefixProvider) ParseLogDirName(name string) (storage.LogID, error) {
+	return DirName2LogID(name)
+}
+
+func (p *LayoutPrefixProvider) ObjectDir(otype storage.ObjectType) (string, error) {
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
+		return p.MassifsDir, nil
+	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
+		return p.CheckpointsDir, nil
 	default:
 		return "", fmt.Errorf("unknown object type %v", otype)
 	}
 }
 
+// LogDirPath returns the directory holding all objects for the selected log
+func (s *CachingStore) LogDirPath() (string, error) {
+	if s.SelectedLogID == nil {
+		return "", storage.ErrLogNotSelected
+	}
+	name, err := s.Opts.PrefixProvider.LogDirName(s.SelectedLogID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Opts.RootDir, filepath.FromSlash(s.Opts.PrefixProvider.LogsDir()), name), nil
+}
+
+// PrefixPath returns the directory holding objects of the type for the selected log, with a trailing separator.
+func (s *CachingStore) PrefixPath(otype storage.ObjectType) (string, error) {
+	logDir, err := s.LogDirPath()
+	if err != nil {
+		return "", err
+	}
+	dir, err := s.Opts.PrefixProvider.ObjectDir(otype)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(logDir, filepath.FromSlash(dir)) + "/", nil
+}
+
 // StoragePath2LogID from the storage path according to the datatrails massif storage schema.
 // The storage path is expected to be in the format:
 // */tenant/<tenant_uuid>/*
@@ -51,3 +142,81 @@ func StoragePath2LogID(storagePath string) (storage.LogID, error) {
 
 	return nil, fmt.Errorf("could not identify log ID in path: %s", storagePath)
 }
+
+// LogID2DirName returns the directory name for the log id. 16 byte log ids
+// are named in the canonical uuid form, so existing log directories keep
+// their names. Log ids of any other length are named in lower case hex.
+func LogID2DirName(logID storage.LogID) (string, error) {
+	if len(logID) == 0 {
+		return "", fmt.Errorf("log id is empty")
+	}
+	if len(logID) == len(uuid.UUID{}) {
+		return uuid.UUID(logID).String(), nil
+	}
+	return hex.EncodeToString(logID), nil
+}
+
+// DirName2LogID is the inverse of LogID2DirName. Only the names it returns
+// are accepted, so each log has exactly one directory name. Upper case,
+// and the hex form of a 16 byte log id, are rejected.
+func DirName2LogID(name string) (storage.LogID, error) {
+	var logID storage.LogID
+	if isUUIDDirName(name) {
+		id, err := uuid.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log directory name %s: %w", name, err)
+		}
+		logID = storage.LogID(id[:])
+	} else {
+		decoded, err := hex.DecodeString(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log directory name %s: %w", name, err)
+		}
+		logID = storage.LogID(decoded)
+	}
+	canonical, err := LogID2DirName(logID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log directory name %s: %w", name, err)
+	}
+	if canonical != name {
+		return nil, fmt.Errorf("invalid log directory name %s: the log is named %s", name, canonical)
+	}
+	return logID, nil
+}
+
+// isUUIDDirName reports whether the name has the canonical uuid form. The hex
+// name of an 18 byte log id has the same length, but no dashes.
+func isUUIDDirName(name string) bool {
+	if len(name) != uuidStringLen {
+		return false
+	}
+	for _, i := range []int{8, 13, 18, 23} {
+		if name[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// StoragePath2EncodedLogID is StoragePath2LogID for log directories named by
+// LogID2DirName, it also accepts log ids which are not uuids.
+// The storage path is expected to be in the format:
+// */log/<dir name>/* or */tenant/<dir name>/*
+func StoragePath2EncodedLogID(storagePath string) (storage.LogID, error) {
+
+	segments := strings.Split(filepath.ToSlash(storagePath), "/")
+
+	// prioritize the neutral, but support both for now.
+	for _, prefix := range []string{LogIDPrefix, DatatrailsLogIDPrefix} {
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] != prefix {
+				continue
+			}
+			if logID, err := DirName2LogID(segments[i+1]); err == nil {
+				return logID, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("could not identify log ID in path: %s", storagePath)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// ReaderAtCloser provides random access reads of an opened object
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// ReaderAtOpener is implemented by Openers which support random access
+// reads. MassifReadAt uses it to read a range without reading the preceding
+// content. For other Openers, the preceding content is read and discarded.
+type ReaderAtOpener interface {
+	Opener
+	OpenReaderAt(name string) (ReaderAtCloser, error)
+}
+
+// ByteRange is a contiguous range of object content starting at Offset
+type ByteRange struct {
+	Offset int64
+	Data   []byte
+}
+
+func (r ByteRange) end() int64 {
+	return r.Offset + int64(len(r.Data))
+}
+
+// RangeCache holds disjoint, sorted, ranges read from a single object
+type RangeCache struct {
+	Ranges []ByteRange
+	size   int
+}
+
+// Get returns the cached bytes for [offset, offset+length) if a single range
+// covers them. The result aliases the cache, and must not be modified.
+func (c *RangeCache) Get(offset, length int64) ([]byte, bool) {
+	i := sort.Search(len(c.Ranges), func(i int) bool { return c.Ranges[i].end() > offset })
+	if i == len(c.Ranges) || c.Ranges[i].Offset > offset || c.Ranges[i].end() < offset+length {
+		return nil, false
+	}
+	start := offset - c.Ranges[i].Offset
+	return c.Ranges[i].Data[start : start+length], true
+}
+
+// Add caches the range, merging it with any ranges it overlaps or adjoins.
+func (c *RangeCache) Add(offset int64, data []byte) {
+	merged := ByteRange{Offset: offset, Data: data}
+	var kept []ByteRange
+	for _, r := range c.Ranges {
+		if r.end() < merged.Offset || r.Offset > merged.end() {
+			kept = append(kept, r)
+			continue
+		}
+		merged = mergeRanges(r, merged)
+	}
+	kept = append(kept, merged)
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Offset < kept[j].Offset })
+	c.Ranges = kept
+
+	c.size = 0
+	for _, r := range c.Ranges {
+		c.size += len(r.Data)
+	}
+}
+
+// mergeRanges combines two overlapping or adjoining ranges. Where they
+// overlap, the content of b is preferred.
+func mergeRanges(a, b ByteRange) ByteRange {
+	lo, hi := min(a.Offset, b.Offset), max(a.end(), b.end())
+	data := make([]byte, hi-lo)
+	copy(data[a.Offset-lo:], a.Data)
+	copy(data[b.Offset-lo:], b.Data)
+	return ByteRange{Offset: lo, Data: data}
+}
+
+// MassifReadAt reads length bytes of massif data starting at offset. The
+// result is served from the cached massif data if that covers the range, and
+// otherwise from the cached ranges, or storage. Ranges read from storage are
+// cached separately, and are never treated as the massif data returned by
+// MassifData.
+//
+// The result is a copy, so it may be modified by the caller, and it remains
+// valid once the cached data is evicted or unmapped.
+//
+// A range need not include the start header, so a massif discovered from its
+// file name is first checked by reading its start header, as MassifStart
+// does, see verifyOnAccess.
+func (s *CachingStore) MassifReadAt(ctx context.Context, massifIndex uint32, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range offset %d, length %d", offset, length)
+	}
+	if err := s.refreshDirsIfStale(); err != nil {
+		return nil, err
+	}
+	storagePath, ok, err := s.dataPath(massifIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// The path is discovered (or not) by PopulateCache given the configured directories.
+		return nil, storage.ErrDoesNotExist
+	}
+	if err := s.refreshFileIfStale(storagePath); err != nil {
+		return nil, err
+	}
+	if s.Selected.Unverified[storagePath] {
+		if _, err := s.MassifStart(ctx, massifIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	if data, ok := s.Selected.MassifData[storagePath]; ok && int64(len(data)) >= offset+length {
+		s.cacheTouch(storagePath, cachedMassif)
+		return bytes.Clone(data[offset : offset+length]), nil
+	}
+	rc, ok := s.Selected.MassifRanges[storagePath]
+	if ok {
+		if data, ok := rc.Get(offset, length); ok {
+			s.cacheTouch(storagePath, cachedRanges)
+			return bytes.Clone(data), nil
+		}
+	}
+
+	data, err := s.readAt(storagePath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if rc == nil {
+		rc = &RangeCache{}
+		s.Selected.MassifRanges[storagePath] = rc
+	}
+	rc.Add(offset, bytes.Clone(data))
+	s.cacheAdd(s.cacheKey(storagePath, cachedRanges), rc.size)
+	return data, nil
+}
+
+func (s *CachingStore) readAt(storagePath string, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+
+	// Compressed massifs can only be read sequentially
+	if ro, ok := s.Opts.ReadOpener.(ReaderAtOpener); ok && !IsCompressed(storagePath) {
+		f, err := ro.OpenReaderAt(storagePath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, storagePath, err)
+		}
+		defer f.Close()
+		n, err := f.ReadAt(data, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(n) == length) {
+			return nil, fmt.Errorf("failed to read %d bytes at %d from %s: %w", length, offset, storagePath, err)
+		}
+		return data, nil
+	}
+
+	f, err := s.openObject(storagePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open file %s (%v)", storage.ErrDoesNotExist, storagePath, err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(io.Discard, f, offset); err != nil {
+		return nil, fmt.Errorf("failed to skip to %d in %s: %w", offset, storagePath, err)
+	}
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes at %d from %s: %w", length, offset, storagePath, err)
+	}
+	return data, nil
+}
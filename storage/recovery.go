@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// RecoveryPolicy selects what the recovery pass run by PopulateCache does with its findings
+type RecoveryPolicy int
+
+const (
+	// RecoveryOff skips the recovery pass entirely
+	RecoveryOff RecoveryPolicy = iota
+	// RecoveryReport records the findings and excludes the affected files
+	// from the cache, but leaves them untouched on disk.
+	RecoveryReport
+	// RecoveryQuarantine moves the affected files into the quarantine directory of the log
+	RecoveryQuarantine
+	// RecoveryRepair removes temporary files and truncates torn massifs to
+	// their last complete value. Findings that can not be repaired are
+	// quarantined.
+	RecoveryRepair
+)
+
+const (
+	QuarantineDirName = "quarantine"
+)
+
+// RecoveryIssue identifies the kind of problem found by the recovery pass
+type RecoveryIssue int
+
+const (
+	// IssueTempFile is a temporary file left by an interrupted Put
+	IssueTempFile RecoveryIssue = iota
+	// IssueTornMassif is a massif whose size is not consistent with its start header
+	IssueTornMassif
+	// IssueTornCheckpoint is a checkpoint that can not be decoded
+	IssueTornCheckpoint
+	// IssueCheckpointAhead is a checkpoint whose MMRSize exceeds the massif data present
+	IssueCheckpointAhead
+)
+
+func (i RecoveryIssue) String() string {
+	switch i {
+	case IssueTempFile:
+		return "temporary file"
+	case IssueTornMassif:
+		return "torn massif"
+	case IssueTornCheckpoint:
+		return "torn checkpoint"
+	case IssueCheckpointAhead:
+		return "checkpoint ahead of massif data"
+	default:
+		return "unknown issue " + strconv.Itoa(int(i))
+	}
+}
+
+// RecoveryAction records what the recovery pass did about a finding
+type RecoveryAction int
+
+const (
+	ActionReported RecoveryAction = iota
+	ActionRepaired
+	ActionQuarantined
+)
+
+type RecoveryFinding struct {
+	Issue  RecoveryIssue
+	Action RecoveryAction
+	Path   string
+	// QuarantinePath is set if the file was moved to quarantine
+	QuarantinePath string
+	Detail         string
+}
+
+func (f RecoveryFinding) String() string {
+	return fmt.Sprintf("%v %s: %s", f.Issue, f.Path, f.Detail)
+}
+
+// Recover runs the recovery pass for the selected log using the given
+// policy. Files affected by findings that were only reported are excluded
+// from the cache until the next recovery pass.
+//
+// The recovery pass looks for temporary files left by interrupted writes,
+// massifs whose size is not consistent with their start header and the
+// massif height, and checkpoints whose MMRSize exceeds the massif data
+// present.
+//
+// Repairs and quarantines are only made while holding the writer lock for
+// the log. If another owner holds it, the findings are reported instead, as
+// the files may belong to a write in progress.
+func (s *CachingStore) Recover(ctx context.Context, policy RecoveryPolicy) ([]RecoveryFinding, error) {
+	if s.Selected == nil {
+		return nil, storage.ErrLogNotSelected
+	}
+	if s.Opts.Archive != nil {
+		return nil, ErrReadOnly
+	}
+	findings, err := s.recoverLog(ctx, policy)
+	if err != nil {
+		return nil, err
+	}
+	s.Selected.RecoveryFindings = findings
+	s.Selected.Excluded = make(map[string]bool)
+	for _, f := range findings {
+		if f.Action == ActionReported {
+			s.Selected.Excluded[f.Path] = true
+		}
+	}
+	return findings, nil
+}
+
+func (s *CachingStore) recoverLog(ctx context.Context, policy RecoveryPolicy) ([]RecoveryFinding, error) {
+	if policy == RecoveryOff {
+		return nil, nil
+	}
+	if policy != RecoveryReport {
+		unlock, err := s.holdLock(ctx, false)
+		switch {
+		case errors.Is(err, ErrLockHeld):
+			policy = RecoveryReport
+		case err != nil:
+			return nil, err
+		default:
+			defer unlock()
+		}
+	}
+
+	var findings []RecoveryFinding
+	report := func(f RecoveryFinding, repair func() error) error {
+		var err error
+		switch {
+		case policy == RecoveryRepair && repair != nil:
+			f.Action = ActionRepaired
+			err = repair()
+		case policy == RecoveryRepair, policy == RecoveryQuarantine:
+			f.Action = ActionQuarantined
+			f.QuarantinePath, err = s.quarantine(f.Path)
+		default:
+			f.Action = ActionReported
+		}
+		if err != nil {
+			return fmt.Errorf("failed to recover %v: %w", f, err)
+		}
+		findings = append(findings, f)
+		return nil
+	}
+
+	massifsDir, err := s.PrefixPath(storage.ObjectMassifData)
+	if err != nil {
+		return nil, err
+	}
+	checkpointsDir, err := s.PrefixPath(storage.ObjectCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// The extent of each massif, as the mmr size covered by its data
+	extents := make(map[uint32]uint64)
+
+	massifFiles, err := NewDirLister().ListFiles(massifsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list massif files in %s: %w", massifsDir, err)
+	}
+	for _, storagePath := range massifFiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if IsTempFile(storagePath) {
+			if err := report(
+				RecoveryFinding{Issue: IssueTempFile, Path: storagePath, Detail: "left by an interrupted write"},
+				func() error { return os.Remove(storagePath) }); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !hasObjectExt(storagePath, s.Opts.MassifExtension) {
+			continue
+		}
+
+		start, size, logStart, detail := s.checkMassifSize(storagePath)
+		if detail == "" {
+			extents[start.MassifIndex] = start.FirstIndex + uint64(size-logStart)/massifs.ValueBytes
+			continue
+		}
+
+		var repair func() error
+		if start != nil && size >= logStart && !IsCompressed(storagePath) && s.plainFiles() {
+			// Truncate to the last complete value, this discards at most a partially appended tail.
+			complete := logStart + ((size-logStart)/massifs.ValueBytes)*massifs.ValueBytes
+			repair = func() error { return os.Truncate(storagePath, complete) }
+			extents[start.MassifIndex] = start.FirstIndex + uint64(complete-logStart)/massifs.ValueBytes
+		}
+		if err := report(RecoveryFinding{Issue: IssueTornMassif, Path: storagePath, Detail: detail}, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	checkpointFiles, err := NewDirLister().ListFiles(checkpointsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list checkpoint files in %s: %w", checkpointsDir, err)
+	}
+	for _, storagePath := range checkpointFiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if IsTempFile(storagePath) {
+			if err := report(
+				RecoveryFinding{Issue: IssueTempFile, Path: storagePath, Detail: "left by an interrupted write"},
+				func() error { return os.Remove(storagePath) }); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(storagePath, s.Opts.SealExtension) {
+			continue
+		}
+
+		checkpt, _, err := s.readCheckpoint(storagePath)
+		if err != nil {
+			if err := report(RecoveryFinding{Issue: IssueTornCheckpoint, Path: storagePath, Detail: err.Error()}, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		mmrSize := checkpt.MMRState.MMRSize
+		massifIndex := uint32(massifs.MassifIndexFromMMRIndex(s.Opts.StorageOptions.MassifHeight, mmrSize-1))
+		extent, ok := extents[massifIndex]
+		if ok && extent >= mmrSize {
+			continue
+		}
+		detail := fmt.Sprintf("checkpoint mmr size %d, massif %d not present", mmrSize, massifIndex)
+		if ok {
+			detail = fmt.Sprintf("checkpoint mmr size %d, massif %d data ends at %d", mmrSize, massifIndex, extent)
+		}
+		if err := report(RecoveryFinding{Issue: IssueCheckpointAhead, Path: storagePath, Detail: detail}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return findings, nil
+}
+
+// checkMassifSize returns a non empty detail if the massif size is not
+// consistent with its start header and the configured massif height. The
+// start header is nil if it can not be read.
+func (s *CachingStore) checkMassifSize(storagePath string) (*massifs.MassifStart, int64, int64, string) {
+	size, err := s.objectSize(storagePath)
+	if err != nil {
+		return nil, 0, 0, err.Error()
+	}
+	if size < massifs.StartHeaderSize {
+		return nil, size, 0, fmt.Sprintf("size %d is smaller than the start header", size)
+	}
+	start, _, err := s.readStart(storagePath)
+	if err != nil {
+		return nil, size, 0, err.Error()
+	}
+	if start.MassifHeight != s.Opts.StorageOptions.MassifHeight {
+		return nil, size, 0, fmt.Sprintf(
+			"massif height %d does not match the configured height %d", start.MassifHeight, s.Opts.StorageOptions.MassifHeight)
+	}
+	logStart, detail := massifSizeDetail(start, size)
+	return start, size, logStart, detail
+}
+
+// massifSizeDetail returns the offset of the log data for the massif, and a
+// non empty detail if size does not end on a value boundary of the log data.
+func massifSizeDetail(start *massifs.MassifStart, size int64) (int64, string) {
+	logStart := int64(massifs.PeakStackEnd(uint64(start.MassifIndex), start.MassifHeight))
+	if size < logStart {
+		return logStart, fmt.Sprintf("size %d is smaller than the log start %d", size, logStart)
+	}
+	if (size-logStart)%massifs.ValueBytes != 0 {
+		return logStart, fmt.Sprintf("size %d ends part way through a value", size)
+	}
+	return logStart, ""
+}
+
+// quarantine moves the file into the quarantine directory of the selected log
+func (s *CachingStore) quarantine(storagePath string) (string, error) {
+	logDir, err := s.LogDirPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(logDir, QuarantineDirName)
+	if err := os.MkdirAll(dir, s.Opts.DirCreateMode); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	target := filepath.Join(dir, filepath.Base(storagePath))
+	if _, err := os.Stat(target); err == nil {
+		target += "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	if err := os.Rename(storagePath, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
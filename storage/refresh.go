@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// RefreshEvent describes the changes made by other writers which a stale
+// check found, and applied to the cache, for the selected log.
+type RefreshEvent struct {
+	LogID storage.LogID
+	// NewMassifs and NewSeals are the indices of newly discovered massifs and checkpoints
+	NewMassifs []uint32
+	NewSeals   []uint32
+	// Changed are the paths of known objects whose content changed on disk
+	Changed []string
+	// Removed are the paths of known objects which no longer exist
+	Removed []string
+}
+
+func (e RefreshEvent) empty() bool {
+	return len(e.NewMassifs) == 0 && len(e.NewSeals) == 0 && len(e.Changed) == 0 && len(e.Removed) == 0
+}
+
+// Refresh brings the selected log cache up to date with changes made by
+// other writers. New massif and checkpoint files are added, removed files are
+// forgotten, and cached data for files which have changed size or
+// modification time is dropped, so that it is re-read on next access. The OnRefresh hook, if set, is called if
+// anything changed.
+func (s *CachingStore) Refresh() (RefreshEvent, error) {
+	if s.Selected == nil {
+		return RefreshEvent{}, storage.ErrLogNotSelected
+	}
+	event := RefreshEvent{LogID: s.SelectedLogID}
+	if err := s.refreshDirs(&event); err != nil {
+		return event, err
+	}
+	for storagePath := range s.Selected.Versions {
+		if err := s.refreshFile(storagePath, &event); err != nil {
+			return event, err
+		}
+	}
+	s.notifyRefresh(event)
+	return event, nil
+}
+
+// refreshDirsIfStale adds files created by other writers to the selected log
+// cache, checking the directories at most once per StaleCheckInterval.
+func (s *CachingStore) refreshDirsIfStale() error {
+	if s.Opts.StaleCheckInterval <= 0 || s.Selected == nil || !s.dueStaleCheck("") {
+		return nil
+	}
+	event := RefreshEvent{LogID: s.SelectedLogID}
+	if err := s.refreshDirs(&event); err != nil {
+		return err
+	}
+	s.notifyRefresh(event)
+	return nil
+}
+
+// refreshFileIfStale drops the cached data for storagePath if another writer
+// has changed it, checking the file at most once per StaleCheckInterval.
+func (s *CachingStore) refreshFileIfStale(storagePath string) error {
+	if s.Opts.StaleCheckInterval <= 0 || s.Selected == nil || !s.dueStaleCheck(storagePath) {
+		return nil
+	}
+	event := RefreshEvent{LogID: s.SelectedLogID}
+	if err := s.refreshFile(storagePath, &event); err != nil {
+		return err
+	}
+	s.notifyRefresh(event)
+	return nil
+}
+
+func (s *CachingStore) dueStaleCheck(key string) bool {
+	now := time.Now()
+	if last, ok := s.Selected.CheckedAt[key]; ok && now.Sub(last) < s.Opts.StaleCheckInterval {
+		return false
+	}
+	s.Selected.CheckedAt[key] = now
+	return true
+}
+
+func (s *CachingStore) notifyRefresh(event RefreshEvent) {
+	if s.Opts.OnRefresh != nil && !event.empty() {
+		s.Opts.OnRefresh(event)
+	}
+}
+
+// refreshDirs adds any files created, and forgets any files removed, since
+// the directories were last listed. The directories are listed again if
+// their modification times changed, or if they were last listed within the
+// modification time granularity of those times.
+func (s *CachingStore) refreshDirs(event *RefreshEvent) error {
+	if s.Opts.RootDir == "" || s.Opts.Archive != nil {
+		return nil
+	}
+	listedAt := time.Now()
+	massifsMTime, sealsMTime, err := s.dirMTimes()
+	if err != nil {
+		return err
+	}
+	if massifsMTime == s.Selected.MassifsMTime && sealsMTime == s.Selected.SealsMTime &&
+		!s.listedWithin(massifsMTime) && !s.listedWithin(sealsMTime) {
+		return nil
+	}
+
+	massifPaths, checkpointPaths, err := s.listObjectPaths()
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, storagePath := range append(slices.Clone(massifPaths), checkpointPaths...) {
+		listed[storagePath] = true
+	}
+	var removed []string
+	for _, paths := range s.Selected.MassifPaths {
+		for _, storagePath := range []string{paths.Data, paths.Checkpoint} {
+			if storagePath != "" && !listed[storagePath] {
+				removed = append(removed, storagePath)
+			}
+		}
+	}
+	for _, storagePath := range removed {
+		relocated, err := s.forgetRemoved(storagePath)
+		if err != nil {
+			return err
+		}
+		if relocated {
+			event.Changed = append(event.Changed, storagePath)
+		} else {
+			event.Removed = append(event.Removed, storagePath)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, paths := range s.Selected.MassifPaths {
+		known[paths.Data] = true
+		known[paths.Checkpoint] = true
+	}
+	for _, storagePath := range massifPaths {
+		if known[storagePath] || s.Selected.Excluded[storagePath] {
+			continue
+		}
+		massifIndex, err := s.addMassifFile(storagePath)
+		if err != nil {
+			return err
+		}
+		event.NewMassifs = append(event.NewMassifs, massifIndex)
+	}
+	for _, storagePath := range checkpointPaths {
+		if known[storagePath] || s.Selected.Excluded[storagePath] {
+			continue
+		}
+		massifIndex, err := s.addCheckpointFile(storagePath)
+		if err != nil {
+			return err
+		}
+		event.NewSeals = append(event.NewSeals, massifIndex)
+	}
+	s.Selected.MassifsMTime, s.Selected.SealsMTime = massifsMTime, sealsMTime
+	s.Selected.ListedAt = listedAt
+	return nil
+}
+
+// listedWithin returns true if the directories were last listed within the
+// modification time granularity of the directory modification time, in
+// which case files created since may not have changed it.
+func (s *CachingStore) listedWithin(mtime int64) bool {
+	return listedWithin(s.Selected.ListedAt, mtime)
+}
+
+// listedWithin returns true if a listing made at listedAt was within the
+// modification time granularity of the directory modification time mtime.
+func listedWithin(listedAt time.Time, mtime int64) bool {
+	if mtime == 0 {
+		// the directory did not exist, creating it will set a time
+		return false
+	}
+	t := time.Unix(0, mtime)
+	return listedAt.Sub(t) <= mtimeGranularity(t)
+}
+
+// refreshFile drops the cached data for storagePath if the file has changed
+// since it was last read or written by this store. Data which covered the
+// whole file is re-read in full on next access, otherwise the same number of
+// bytes are re-read.
+func (s *CachingStore) refreshFile(storagePath string, event *RefreshEvent) error {
+	v, ok := s.Selected.Versions[storagePath]
+	if !ok || s.Opts.Archive != nil {
+		return nil
+	}
+	info, err := os.Stat(storagePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Typically compressed by another writer once it was sealed
+		relocated, err := s.forgetRemoved(storagePath)
+		if err != nil {
+			return err
+		}
+		if relocated {
+			event.Changed = append(event.Changed, storagePath)
+		} else {
+			event.Removed = append(event.Removed, storagePath)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s for changes: %w", storagePath, err)
+	}
+	if info.Size() == v.Size && info.ModTime().Equal(v.ModTime) {
+		return nil
+	}
+	delete(s.Selected.Versions, storagePath)
+
+	if data, ok := s.Selected.MassifData[storagePath]; ok {
+		// If the whole massif was cached, the whole massif is re-read,
+		// whatever its new size
+		n := len(data)
+		if int64(n) == v.ContentSize {
+			n = -1
+		}
+		s.cacheDrop(storagePath, cachedMassif)
+		s.cacheDropRanges(storagePath)
+		if err := s.unmapMassif(storagePath); err != nil {
+			return err
+		}
+		s.Selected.Evicted[storagePath] = n
+	}
+	if data, ok := s.Selected.CheckpointData[storagePath]; ok {
+		s.cacheDrop(storagePath, cachedCheckpoint)
+		s.Selected.Evicted[storagePath] = len(data)
+	}
+	event.Changed = append(event.Changed, storagePath)
+	return nil
+}
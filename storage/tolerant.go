@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+var (
+	ErrCorruptFiles = errors.New("files that could not be loaded were left out of the log")
+)
+
+// CorruptFilePolicy selects what PopulateCache does with massif and
+// checkpoint files that can not be read or decoded.
+type CorruptFilePolicy int
+
+const (
+	// CorruptFileFail fails PopulateCache if any file can not be loaded
+	CorruptFileFail CorruptFilePolicy = iota
+	// CorruptFileSkip leaves the files out of the cache
+	CorruptFileSkip
+	// CorruptFileQuarantine leaves the files out of the cache, and moves them
+	// into the quarantine directory of the log.
+	CorruptFileQuarantine
+)
+
+func (p CorruptFilePolicy) String() string {
+	switch p {
+	case CorruptFileFail:
+		return "fail"
+	case CorruptFileSkip:
+		return "skip"
+	case CorruptFileQuarantine:
+		return "quarantine"
+	default:
+		return "unknown policy " + strconv.Itoa(int(p))
+	}
+}
+
+// CorruptFile records a file left out of the cache by PopulateCache
+type CorruptFile struct {
+	Path string
+	// QuarantinePath is set if the file was moved to quarantine
+	QuarantinePath string
+	Err            error
+}
+
+func (f CorruptFile) String() string {
+	if f.QuarantinePath != "" {
+		return fmt.Sprintf("%s (quarantined to %s): %v", f.Path, f.QuarantinePath, f.Err)
+	}
+	return fmt.Sprintf("%s: %v", f.Path, f.Err)
+}
+
+// CorruptFilesError aggregates the errors for the files left out of the
+// cache under CorruptFileSkip or CorruptFileQuarantine. It is reported by
+// CorruptFiles, selecting the log succeeds, and the files that could be
+// loaded remain usable.
+type CorruptFilesError struct {
+	Files []CorruptFile
+}
+
+func (e *CorruptFilesError) Error() string {
+	details := make([]string, 0, len(e.Files))
+	for _, f := range e.Files {
+		details = append(details, f.String())
+	}
+	return fmt.Sprintf("%v: %s", ErrCorruptFiles, strings.Join(details, "; "))
+}
+
+func (e *CorruptFilesError) Unwrap() []error {
+	errs := []error{ErrCorruptFiles}
+	for _, f := range e.Files {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// tolerantLoad returns load unchanged if corrupt files fail PopulateCache.
+// Otherwise, a file that can not be loaded is returned with its error set,
+// rather than failing the load.
+func (s *CachingStore) tolerantLoad(load func(string) (loadedObject, error)) func(string) (loadedObject, error) {
+	if s.Opts.CorruptFiles == CorruptFileFail {
+		return load
+	}
+	return func(storagePath string) (loadedObject, error) {
+		l, err := load(storagePath)
+		if err != nil {
+			return loadedObject{path: storagePath, err: err}, nil
+		}
+		return l, nil
+	}
+}
+
+// leaveOut records a file that could not be loaded, quarantining it if the
+// policy requires. As for recovery, files are only moved with the writer lock
+// held. If another writer holds it, the file is skipped instead.
+func (s *CachingStore) leaveOut(ctx context.Context, storagePath string, loadErr error) error {
+	f := CorruptFile{Path: storagePath, Err: loadErr}
+	if s.Opts.CorruptFiles == CorruptFileQuarantine && s.Opts.RootDir != "" && s.Opts.Archive == nil {
+		unlock, err := s.holdLock(ctx, false)
+		switch {
+		case errors.Is(err, ErrLockHeld):
+		case err != nil:
+			return err
+		default:
+			f.QuarantinePath, err = s.quarantine(storagePath)
+			if err = errors.Join(err, unlock()); err != nil {
+				return fmt.Errorf("failed to quarantine %s: %w", storagePath, err)
+			}
+		}
+	}
+	s.Selected.CorruptFiles = append(s.Selected.CorruptFiles, f)
+	return nil
+}
+
+// CorruptFiles returns the files left out of the selected log by the most
+// recent PopulateCache, or nil if there were none.
+func (s *CachingStore) CorruptFiles() (*CorruptFilesError, error) {
+	if s.Selected == nil {
+		return nil, storage.ErrLogNotSelected
+	}
+	if len(s.Selected.CorruptFiles) == 0 {
+		return nil, nil
+	}
+	return &CorruptFilesError{Files: slices.Clone(s.Selected.CorruptFiles)}, nil
+}
+
+func (h *LogHandle) CorruptFiles() (*CorruptFilesError, error) {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	if err := h.store.activate(context.Background(), h.logID); err != nil {
+		return nil, err
+	}
+	return h.store.CorruptFiles()
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+var (
+	ErrWriteConflict = errors.New("object changed since it was last read or written by this store")
+)
+
+// VersionToken identifies the content of a stored object at the time it was
+// last read or written by the store. Size and ModTime are of the file on
+// disk. ContentSize is the size of the content, before any compression or
+// encryption, and is zero when only part of the object was read. Hash is of
+// the content, and is only recorded when the whole object was read and it
+// was modified so recently that a further change could leave its ModTime
+// the same, see mtimeGranularity. Otherwise only Size and ModTime are
+// compared.
+type VersionToken struct {
+	Size        int64
+	ModTime     time.Time
+	ContentSize int64
+	Hash        []byte
+}
+
+// Matches returns true if other describes the same content. The hashes are
+// only compared when both tokens have one.
+func (v VersionToken) Matches(other VersionToken) bool {
+	if v.Size != other.Size || !v.ModTime.Equal(other.ModTime) {
+		return false
+	}
+	if v.Hash == nil || other.Hash == nil {
+		return true
+	}
+	return bytes.Equal(v.Hash, other.Hash)
+}
+
+// WriteConflictError is returned by Put when the object on disk no longer
+// matches the version recorded when the store last read or wrote it. Actual
+// is nil if the object has since been removed.
+type WriteConflictError struct {
+	Path     string
+	Expected VersionToken
+	Actual   *VersionToken
+}
+
+func (e *WriteConflictError) Error() string {
+	if e.Actual == nil {
+		return fmt.Sprintf("%v: %s has been removed", ErrWriteConflict, e.Path)
+	}
+	return fmt.Sprintf(
+		"%v: %s expected size %d, modified %v, found size %d, modified %v",
+		ErrWriteConflict, e.Path, e.Expected.Size, e.Expected.ModTime, e.Actual.Size, e.Actual.ModTime)
+}
+
+func (e *WriteConflictError) Unwrap() error {
+	return ErrWriteConflict
+}
+
+// Version returns the version token recorded for the object, if the store has read or written it.
+func (s *CachingStore) Version(massifIndex uint32, ty storage.ObjectType) (VersionToken, bool) {
+	paths, ok, err := s.paths(massifIndex)
+	if err != nil || !ok {
+		return VersionToken{}, false
+	}
+	storagePath := paths.Data
+	if ty == storage.ObjectCheckpoint {
+		storagePath = paths.Checkpoint
+	}
+	v, ok := s.Selected.Versions[storagePath]
+	return v, ok
+}
+
+// recordVersion notes the version of the object just read from, or written
+// to, storagePath. data is the full content when complete is true, otherwise
+// the hash is omitted.
+func (s *CachingStore) recordVersion(storagePath string, info fs.FileInfo, data []byte, complete bool) {
+	if s.Selected == nil || info == nil {
+		return
+	}
+	v := VersionToken{Size: info.Size(), ModTime: info.ModTime()}
+	if complete {
+		v.ContentSize = int64(len(data))
+		if time.Since(v.ModTime) < mtimeGranularity(v.ModTime) {
+			sum := sha256.Sum256(data)
+			v.Hash = sum[:]
+		}
+	}
+	s.Selected.Versions[storagePath] = v
+}
+
+// recordWrittenVersion records the version of content this store has just written
+func (s *CachingStore) recordWrittenVersion(storagePath string, data []byte) error {
+	info, err := os.Stat(storagePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s after writing: %w", storagePath, err)
+	}
+	s.recordVersion(storagePath, info, data, true)
+	return nil
+}
+
+// checkVersion returns a *WriteConflictError if the object at storagePath has
+// changed since the store recorded its version. Objects the store has never
+// read or written are not checked.
+//
+// The check is made immediately before the write, with the per log writer
+// lock held, see lockForPut. Writers which do not take the lock can still
+// interleave between the check and the write.
+//
+// The content is only hashed if the version recorded a hash, that is if the
+// object may have been changed again within the same mtime tick. It is read
+// through the ReadOpener, as the hash is of the content rather than the file.
+func (s *CachingStore) checkVersion(storagePath string) error {
+	expected, ok := s.Selected.Versions[storagePath]
+	if !ok {
+		return nil
+	}
+
+	info, err := os.Stat(storagePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &WriteConflictError{Path: storagePath, Expected: expected}
+		}
+		return fmt.Errorf("failed to stat %s to check version: %w", storagePath, err)
+	}
+	actual := VersionToken{Size: info.Size(), ModTime: info.ModTime()}
+
+	if expected.Hash != nil && actual.Matches(expected) {
+		sum, err := s.hashObject(storagePath)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s to check version: %w", storagePath, err)
+		}
+		if actual.Hash, err = hex.DecodeString(sum); err != nil {
+			return err
+		}
+	}
+	if !actual.Matches(expected) {
+		return &WriteConflictError{Path: storagePath, Expected: expected, Actual: &actual}
+	}
+	return nil
+}
+
+// mtimeGranularity returns the resolution to assume for modification times
+// like t. Whole second times suggest a file system which records seconds, or
+// even two seconds for FAT. Finer times are still only as fine as the kernel
+// clock tick.
+func mtimeGranularity(t time.Time) time.Duration {
+	if t.Nanosecond() == 0 {
+		return 2 * time.Second
+	}
+	return 10 * time.Millisecond
+}
+
+// fileInfo returns the FileInfo for an opened object, if the opener provides it
+func fileInfo(f io.ReadCloser) fs.FileInfo {
+	st, ok := f.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	info, err := st.Stat()
+	if err != nil {
+		return nil
+	}
+	return info
+}
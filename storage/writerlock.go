@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// WriterLockMode controls when a CachingStore takes the advisory writer lock for a log
+type WriterLockMode int
+
+const (
+	// WriterLockNone only holds the writer lock for the duration of each Put,
+	// see lockForPut. LockLog and TryLockLog can still be called explicitly.
+	WriterLockNone WriterLockMode = iota
+	// WriterLockOnSelect takes the lock when the log is selected.
+	WriterLockOnSelect
+	// WriterLockOnPut takes the lock on the first Put to the selected log.
+	WriterLockOnPut
+)
+
+const (
+	WriterLockFileName = "writer.lock"
+	lockPollInterval   = 50 * time.Millisecond
+)
+
+var (
+	ErrLockHeld = errors.New("log writer lock is held by another owner")
+)
+
+// LockHeldError reports the holder of a contended writer lock, as recorded
+// in the lock file by the holder when it acquired the lock.
+type LockHeldError struct {
+	Path     string
+	PID      int
+	Hostname string
+	// Stale is true if the holder claims to be on this host, but its process no longer exists.
+	Stale bool
+}
+
+func (e *LockHeldError) Error() string {
+	msg := fmt.Sprintf("%v: %s held by pid %d on %s", ErrLockHeld, e.Path, e.PID, e.Hostname)
+	if e.Stale {
+		msg += " (the holding process no longer exists, the lock may be stale)"
+	}
+	return msg
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return ErrLockHeld
+}
+
+// TryLockLog takes the writer lock for the selected log without waiting. If
+// another owner holds it, a *LockHeldError is returned. Taking a lock that
+// this store already holds succeeds immediately.
+func (s *CachingStore) TryLockLog() error {
+	if s.Selected == nil {
+		return storage.ErrLogNotSelected
+	}
+	return s.tryLockLog()
+}
+
+// LockLog takes the writer lock for the selected log, waiting until it is
+// released by its current holder or the context is done.
+func (s *CachingStore) LockLog(ctx context.Context) error {
+	if s.Selected == nil {
+		return storage.ErrLogNotSelected
+	}
+	return s.waitLock(ctx)
+}
+
+// waitLock polls for the writer lock for the log named by SelectedLogID
+func (s *CachingStore) waitLock(ctx context.Context) error {
+	return pollLock(ctx, s.tryLockLog)
+}
+
+// pollLock calls tryLock until it does not fail with ErrLockHeld, or the context is done
+func pollLock(ctx context.Context, tryLock func() error) error {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		err := tryLock()
+		if err == nil || !errors.Is(err, ErrLockHeld) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// UnlockLog releases the writer lock held by this store for the log, if any.
+func (s *CachingStore) UnlockLog(logId storage.LogID) error {
+	sh := s.shared
+	sh.mu.Lock()
+	f, ok := sh.locks[string(logId)]
+	delete(sh.locks, string(logId))
+	sh.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return errors.Join(unlockFile(f), f.Close())
+}
+
+// Close releases all resources held by the store, and by the stores behind
+// its handles, including any writer locks and memory mapped massifs.
+func (s *CachingStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := []error{s.unmapAll()}
+
+	sh := s.shared
+	sh.mu.Lock()
+	logStores := slices.Collect(maps.Values(sh.logStores))
+	lockedLogs := slices.Collect(maps.Keys(sh.locks))
+	sh.mu.Unlock()
+	for _, ls := range logStores {
+		ls.mu.Lock()
+		errs = append(errs, ls.unmapAll())
+		ls.mu.Unlock()
+	}
+	for _, key := range lockedLogs {
+		errs = append(errs, s.UnlockLog(storage.LogID(key)))
+	}
+	if s.ownsArchive {
+		errs = append(errs, s.Opts.Archive.Close())
+		s.ownsArchive = false
+	}
+	return errors.Join(errs...)
+}
+
+// lockForWrite takes the writer lock according to the configured mode, if it is not already held.
+func (s *CachingStore) lockForWrite(ctx context.Context, mode WriterLockMode) error {
+	if s.Opts.WriterLock != mode || s.Opts.Archive != nil {
+		return nil
+	}
+	if s.Opts.WriterLockNoWait {
+		return s.tryLockLog()
+	}
+	return s.waitLock(ctx)
+}
+
+// lockForPut takes the writer lock for a Put, so that the version check made
+// by Put and the write are not interleaved with those of another store.
+func (s *CachingStore) lockForPut(ctx context.Context) (func() error, error) {
+	return s.holdLock(ctx, !s.Opts.WriterLockNoWait)
+}
+
+// holdLock takes the writer lock for an operation which modifies the log,
+// waiting for it if wait is set. The returned func releases the lock again
+// if the configured mode would not otherwise have held it. On platforms
+// without advisory locks, a single writer per log is assumed, as it was
+// before the lock existed.
+func (s *CachingStore) holdLock(ctx context.Context, wait bool) (func() error, error) {
+	noop := func() error { return nil }
+	if s.holdsLock(s.SelectedLogID) {
+		return noop, nil
+	}
+	var err error
+	if wait {
+		err = s.waitLock(ctx)
+	} else {
+		err = s.tryLockLog()
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		return noop, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Opts.WriterLock != WriterLockNone {
+		return noop, nil
+	}
+	logId := s.SelectedLogID
+	return func() error { return s.UnlockLog(logId) }, nil
+}
+
+// holdsLock returns true if this store, or a store sharing its state, holds the writer lock for the log
+func (s *CachingStore) holdsLock(logId storage.LogID) bool {
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+	_, ok := s.shared.locks[string(logId)]
+	return ok
+}
+
+// tryLockLog makes a single attempt to take the writer lock for the
+// selected log. The shared lock is held for the attempt, so that the store
+// and its handles never lock the file twice.
+func (s *CachingStore) tryLockLog() error {
+	key := string(s.SelectedLogID)
+	sh := s.shared
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.locks[key]; ok {
+		return nil
+	}
+
+	logDir, err := s.LogDirPath()
+	if err != nil {
+		return err
+	}
+	f, err := s.lockFile(logDir)
+	if err != nil {
+		return err
+	}
+
+	if sh.locks == nil {
+		sh.locks = make(map[string]*os.File)
+	}
+	sh.locks[key] = f
+	return nil
+}
+
+// lockFile makes a single attempt to take the writer lock file in the log
+// directory, creating the directory if necessary. The open lock file is
+// returned, and holds the lock until it is unlocked and closed.
+func (s *CachingStore) lockFile(logDir string) (*os.File, error) {
+	if err := os.MkdirAll(logDir, s.Opts.DirCreateMode); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", logDir, err)
+	}
+	lockPath := filepath.Join(logDir, WriterLockFileName)
+
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, s.Opts.FileCreateMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", lockPath, err)
+	}
+	acquired, err := tryLockFile(f)
+	if err != nil || !acquired {
+		defer f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+		return nil, lockHolder(lockPath, f)
+	}
+
+	// Record the holder so that contending processes can report it.
+	hostname, _ := os.Hostname()
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), hostname)), 0)
+		if err == nil {
+			err = f.Sync()
+		}
+	}
+	return f, nil
+}
+
+// lockHolder reads the holder details recorded in a contended lock file
+func lockHolder(lockPath string, f *os.File) error {
+	held := &LockHeldError{Path: lockPath}
+	buf := make([]byte, 512)
+	n, _ := f.ReadAt(buf, 0)
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) > 0 {
+		fmt.Sscanf(fields[0], "%d", &held.PID)
+	}
+	if len(fields) > 1 {
+		held.Hostname = fields[1]
+	}
+	if hostname, err := os.Hostname(); err == nil && held.PID > 0 && held.Hostname == hostname {
+		held.Stale = !processExists(held.PID)
+	}
+	return held
+}
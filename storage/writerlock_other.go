@@ -0,0 +1,20 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func processExists(pid int) bool {
+	return true
+}
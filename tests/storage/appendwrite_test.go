@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPut_appendsExtendedMassif(t *testing.T) {
+	store, logID := newTempDirStore(t)
+	ctx := t.Context()
+
+	prefix, err := store.PrefixPath(storage.ObjectMassifData)
+	require.NoError(t, err)
+	storagePath, err := storage.ObjectPath(prefix, logID, 0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectMassifData, []byte("aaaa"), true))
+	before, err := os.Stat(storagePath)
+	require.NoError(t, err)
+
+	// extending the cached content appends in place, so the file is not replaced
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectMassifData, []byte("aaaabbbb"), false))
+	after, err := os.Stat(storagePath)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after))
+
+	data, err := os.ReadFile(storagePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("aaaabbbb"), data)
+
+	// a differing prefix falls back to a full, atomic, rewrite
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectMassifData, []byte("cccccccccc"), false))
+	replaced, err := os.Stat(storagePath)
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(after, replaced))
+
+	data, err = os.ReadFile(storagePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("cccccccccc"), data)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTar(t *testing.T, rootDir string, archivePath string) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.AddFS(os.DirFS(rootDir)))
+	require.NoError(t, tw.Close())
+	require.NoError(t, os.WriteFile(archivePath, buf.Bytes(), 0644))
+}
+
+func writeZip(t *testing.T, rootDir string, archivePath string, method uint16) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.ToSlash(rel), Method: method})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(archivePath, buf.Bytes(), 0644))
+}
+
+func TestArchive_readsLogs(t *testing.T) {
+	l, store := newTestLog(t, fsstorage.FSOptions{}, 3)
+	require.NoError(t, store.Close())
+	rootDir := l.TC.Cfg.RootDir
+	archiveDir := t.TempDir()
+
+	tests := []struct {
+		name  string
+		write func(archivePath string)
+	}{
+		{"tar", func(archivePath string) { writeTar(t, rootDir, archivePath) }},
+		{"zip stored", func(archivePath string) { writeZip(t, rootDir, archivePath, zip.Store) }},
+		{"zip deflated", func(archivePath string) { writeZip(t, rootDir, archivePath, zip.Deflate) }},
+	}
+	for _, tt := range tests {
+		archivePath := filepath.Join(archiveDir, tt.name)
+		tt.write(archivePath)
+		for _, lazy := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s lazy %v", tt.name, lazy), func(t *testing.T) {
+				ctx := t.Context()
+				store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{RootDir: archivePath, LazySelect: lazy}))
+				require.NoError(t, err)
+				defer store.Close()
+
+				page, err := store.ListLogs(ctx, fsstorage.ListLogsOptions{})
+				require.NoError(t, err)
+				require.Len(t, page.Logs, 1)
+				assert.Equal(t, l.LogID, page.Logs[0].LogID)
+				assert.Equal(t, 3, page.Logs[0].MassifCount)
+
+				require.NoError(t, store.SelectLog(ctx, l.LogID))
+				head, err := store.HeadIndex(ctx, storage.ObjectMassifData)
+				require.NoError(t, err)
+				assert.Equal(t, uint32(2), head)
+
+				for massifIndex, want := range l.Massifs {
+					data, err := store.MassifReadN(ctx, uint32(massifIndex), -1)
+					require.NoError(t, err)
+					assert.Equal(t, want, data)
+					data, err = store.CheckpointRead(ctx, uint32(massifIndex))
+					require.NoError(t, err)
+					assert.Equal(t, l.Checkpoints[massifIndex], data)
+				}
+				start, err := store.MassifStart(ctx, 1)
+				require.NoError(t, err)
+				assert.Equal(t, uint32(1), start.MassifIndex)
+				data, err := store.MassifReadAt(ctx, 0, massifs.StartHeaderSize, massifs.ValueBytes)
+				require.NoError(t, err)
+				assert.Equal(t, l.Massifs[0][massifs.StartHeaderSize:massifs.StartHeaderSize+massifs.ValueBytes], data)
+
+				err = store.Put(ctx, 3, storage.ObjectMassifData, l.Massifs[2], true)
+				assert.ErrorIs(t, err, fsstorage.ErrReadOnly)
+			})
+		}
+	}
+}
+
+// oneByteOpener returns readers which read a byte at a time, as a reader
+// over a compressed archive member may
+type oneByteOpener struct {
+	fsstorage.Opener
+}
+
+func (o oneByteOpener) Open(name string) (io.ReadCloser, error) {
+	f, err := o.Opener.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{iotest.OneByteReader(f), f}, nil
+}
+
+func TestMassifReadN_shortReads(t *testing.T) {
+	ctx := t.Context()
+	l, _ := newTestLog(t, fsstorage.FSOptions{}, 2)
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{
+		ReadOpener: oneByteOpener{fsstorage.NewFileOpener()},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+
+	data, err := store.MassifReadN(ctx, 1, massifs.StartHeaderSize)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[1][:massifs.StartHeaderSize], data)
+	start, err := store.MassifStart(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), start.MassifIndex)
+}
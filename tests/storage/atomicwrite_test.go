@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTempDirStore(t *testing.T) (*fsstorage.CachingStore, storage.LogID) {
+	t.Helper()
+	store, err := fsstorage.NewStore(t.Context(), fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: t.TempDir()}})
+	require.NoError(t, err)
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	require.NoError(t, store.SelectLog(t.Context(), logID))
+	return store, logID
+}
+
+func TestPut_atomicReplace(t *testing.T) {
+	store, _ := newTempDirStore(t)
+	ctx := t.Context()
+
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("first"), true))
+
+	// exclusive create must not replace the existing object
+	err := store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("second"), true)
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("third"), false))
+
+	prefix, err := store.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	storagePath, err := storage.ObjectPath(prefix, store.SelectedLogID, 0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	data, err := os.ReadFile(storagePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("third"), data)
+
+	// no temporary files are left behind, even for the failed exclusive put
+	entries, err := os.ReadDir(filepath.Dir(storagePath))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, fsstorage.IsTempFile(entry.Name()), entry.Name())
+	}
+	assert.Len(t, entries, 1)
+}
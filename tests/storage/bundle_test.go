@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBundleStore returns a store, for importing the log, in a new root directory
+func newBundleStore(t *testing.T, l *testLog) *fsstorage.CachingStore {
+	t.Helper()
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{RootDir: t.TempDir()}))
+	require.NoError(t, err)
+	return store
+}
+
+func TestBundle_exportImportRange(t *testing.T) {
+	ctx := t.Context()
+	l, source := newTestLog(t, fsstorage.FSOptions{}, 3)
+	logID := l.LogID
+
+	var bundle bytes.Buffer
+	exported, err := source.Export(ctx, logID, &bundle, fsstorage.ExportOptions{Range: &fsstorage.IndexRange{First: 1, Last: 2}})
+	require.NoError(t, err)
+	assert.Len(t, exported.Massifs, 2)
+	assert.Len(t, exported.Checkpoints, 2)
+	assert.Equal(t, uint32(1), exported.FirstMassif)
+	assert.Equal(t, uint32(2), exported.HeadSeal)
+
+	target := newBundleStore(t, l)
+	imported, err := target.Import(ctx, bytes.NewReader(bundle.Bytes()), fsstorage.ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, exported, imported)
+
+	require.NoError(t, target.SelectLog(ctx, logID))
+	data, err := target.MassifReadN(ctx, 2, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[2], data)
+	data, err = target.CheckpointRead(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Checkpoints[1], data)
+	_, err = target.MassifReadN(ctx, 0, -1)
+	assert.ErrorIs(t, err, storage.ErrDoesNotExist)
+
+	// importing again is a no-op
+	_, err = target.Import(ctx, bytes.NewReader(bundle.Bytes()), fsstorage.ImportOptions{})
+	require.NoError(t, err)
+
+	// different content for an object the log already has
+	require.NoError(t, source.SelectLog(ctx, logID))
+	checkpt, err := source.Checkpoint(ctx, 2)
+	require.NoError(t, err)
+	state := checkpt.MMRState
+	state.Timestamp++
+	resealed, err := l.checkpoint(state)
+	require.NoError(t, err)
+	require.NoError(t, source.Put(ctx, 2, storage.ObjectCheckpoint, resealed, false))
+	bundle.Reset()
+	_, err = source.Export(ctx, logID, &bundle, fsstorage.ExportOptions{})
+	require.NoError(t, err)
+	_, err = target.Import(ctx, bytes.NewReader(bundle.Bytes()), fsstorage.ImportOptions{})
+	assert.ErrorIs(t, err, fsstorage.ErrBundleConflict)
+}
+
+func TestBundle_exportWritesWithoutTheLogLock(t *testing.T) {
+	ctx := t.Context()
+	l, source := newTestLog(t, fsstorage.FSOptions{}, 2)
+
+	// nothing reads the bundle until the log has been used
+	r, w := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		_, err := source.Export(ctx, l.LogID, w, fsstorage.ExportOptions{})
+		w.CloseWithError(err)
+		exported <- err
+	}()
+
+	h, err := source.Log(ctx, l.LogID)
+	require.NoError(t, err)
+	head, err := h.HeadIndex(ctx, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), head)
+
+	target := newBundleStore(t, l)
+	_, err = target.Import(ctx, r, fsstorage.ImportOptions{})
+	require.NoError(t, err)
+	require.NoError(t, <-exported)
+}
+
+// rewriteBundle copies the bundle, passing each member through edit
+func rewriteBundle(t *testing.T, bundle []byte, edit func(hdr *tar.Header, data []byte) []byte) *bytes.Buffer {
+	t.Helper()
+	var rewritten bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	tw := tar.NewWriter(&rewritten)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		data = edit(hdr, data)
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &rewritten
+}
+
+// editManifest returns an edit which changes the bundle manifest
+func editManifest(t *testing.T, change func(m *fsstorage.BundleManifest)) func(*tar.Header, []byte) []byte {
+	return func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name != fsstorage.BundleManifestName {
+			return data
+		}
+		var m fsstorage.BundleManifest
+		require.NoError(t, json.Unmarshal(data, &m))
+		change(&m)
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		return data
+	}
+}
+
+func TestBundle_importRejectsTampering(t *testing.T) {
+	ctx := t.Context()
+	l, source := newTestLog(t, fsstorage.FSOptions{}, 2)
+	logID := l.LogID
+
+	var bundle bytes.Buffer
+	_, err := source.Export(ctx, logID, &bundle, fsstorage.ExportOptions{})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		edit func(hdr *tar.Header, data []byte) []byte
+	}{
+		{"flipped byte", func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name != fsstorage.BundleManifestName {
+				data[len(data)-1] ^= 0xff
+			}
+			return data
+		}},
+		{"index not matching the name", editManifest(t, func(m *fsstorage.BundleManifest) {
+			m.Checkpoints[0].MassifIndex = 5
+		})},
+		{"massifs swapped", func() func(*tar.Header, []byte) []byte {
+			// the manifest matches the swapped content, but the start headers do not
+			var m fsstorage.BundleManifest
+			members := map[string][]byte{}
+			rewriteBundle(t, bundle.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == fsstorage.BundleManifestName {
+					require.NoError(t, json.Unmarshal(data, &m))
+				}
+				members[hdr.Name] = data
+				return data
+			})
+			first, second := m.Massifs[0], m.Massifs[1]
+			return func(hdr *tar.Header, data []byte) []byte {
+				switch hdr.Name {
+				case first.Name:
+					return members[second.Name]
+				case second.Name:
+					return members[first.Name]
+				case fsstorage.BundleManifestName:
+					return editManifest(t, func(m *fsstorage.BundleManifest) {
+						m.Massifs[0].Size, m.Massifs[0].SHA256 = second.Size, second.SHA256
+						m.Massifs[1].Size, m.Massifs[1].SHA256 = first.Size, first.SHA256
+					})(hdr, data)
+				}
+				return data
+			}
+		}()},
+		{"checkpoint for another massif", func() func(*tar.Header, []byte) []byte {
+			// the manifest matches the content, but the checkpoint mmr size does not
+			var m fsstorage.BundleManifest
+			var first []byte
+			rewriteBundle(t, bundle.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == fsstorage.BundleManifestName {
+					require.NoError(t, json.Unmarshal(data, &m))
+				}
+				if len(m.Checkpoints) != 0 && hdr.Name == m.Checkpoints[0].Name {
+					first = data
+				}
+				return data
+			})
+			return func(hdr *tar.Header, data []byte) []byte {
+				switch hdr.Name {
+				case m.Checkpoints[1].Name:
+					return first
+				case fsstorage.BundleManifestName:
+					return editManifest(t, func(m *fsstorage.BundleManifest) {
+						m.Checkpoints[1].Size, m.Checkpoints[1].SHA256 = m.Checkpoints[0].Size, m.Checkpoints[0].SHA256
+					})(hdr, data)
+				}
+				return data
+			}
+		}()},
+		{"oversized manifest", func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == fsstorage.BundleManifestName {
+				return append(data, bytes.Repeat([]byte(" "), 64<<20)...)
+			}
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := rewriteBundle(t, bundle.Bytes(), tt.edit)
+			target := newBundleStore(t, l)
+			_, err := target.Import(ctx, tampered, fsstorage.ImportOptions{})
+			assert.ErrorIs(t, err, fsstorage.ErrInvalidBundle)
+			require.NoError(t, target.SelectLog(ctx, logID))
+			_, err = target.MassifReadN(ctx, 0, -1)
+			assert.ErrorIs(t, err, storage.ErrDoesNotExist)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums_detectBitRot(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{Checksums: true}, 3)
+	massifPath := l.path(t, store, 0, storage.ObjectMassifData)
+	_, err := os.Stat(fsstorage.ChecksumPath(massifPath))
+	require.NoError(t, err)
+
+	// flip a byte in the log data, leaving the size and start header unchanged
+	corrupt := append([]byte(nil), l.Massifs[0]...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(massifPath, corrupt, 0644))
+
+	for _, lazy := range []bool{false, true} {
+		store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{Checksums: true, LazySelect: lazy}))
+		require.NoError(t, err)
+		require.NoError(t, store.SelectLog(ctx, l.LogID))
+
+		_, err = store.MassifReadN(ctx, 0, -1)
+		assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+		var checksumErr *fsstorage.ChecksumError
+		require.True(t, errors.As(err, &checksumErr))
+		assert.Equal(t, massifPath, checksumErr.Path)
+
+		data, err := store.CheckpointRead(ctx, 0)
+		require.NoError(t, err)
+		assert.Equal(t, l.Checkpoints[0], data)
+		data, err = store.MassifReadN(ctx, 1, -1)
+		require.NoError(t, err)
+		assert.Equal(t, l.Massifs[1], data)
+	}
+
+	result, err := store.Scrub(ctx, l.LogID)
+	require.NoError(t, err)
+	assert.Equal(t, 6, result.Checked)
+	assert.Empty(t, result.Unchecked)
+	require.Len(t, result.Corrupt, 1)
+	assert.Equal(t, massifPath, result.Corrupt[0].Path)
+}
+
+func TestChecksums_detectsSizeChanges(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{Checksums: true}, 2)
+	massifPath := l.path(t, store, 0, storage.ObjectMassifData)
+
+	// a truncated massif only has a different digest if it is read in full
+	require.NoError(t, os.WriteFile(massifPath, l.Massifs[0][:len(l.Massifs[0])-1], 0644))
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{Checksums: true, LazySelect: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	_, err = store.MassifReadN(ctx, 0, -1)
+	assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+}
+
+func TestChecksums_verifyMappedMassifs(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{Checksums: true}, 3)
+	massifPath := l.path(t, store, 0, storage.ObjectMassifData)
+	corrupt := append([]byte(nil), l.Massifs[0]...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(massifPath, corrupt, 0644))
+
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{Checksums: true, LazySelect: true, MmapSealed: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	_, err = store.MassifReadN(ctx, 0, -1)
+	assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+	_, err = store.MassifReadN(ctx, 0, 16)
+	assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+
+	data, err := store.MassifReadN(ctx, 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[1], data)
+}
+
+func TestChecksums_replacingRemovesTheSidecar(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{Checksums: true}, 2)
+	checkpointPath := l.path(t, store, 1, storage.ObjectCheckpoint)
+
+	// a store without checksums replaces the checkpoint
+	checkpt, err := store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+	state := checkpt.MMRState
+	state.Timestamp++
+	resealed, err := l.checkpoint(state)
+	require.NoError(t, err)
+	plain, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{LazySelect: true}))
+	require.NoError(t, err)
+	require.NoError(t, plain.SelectLog(ctx, l.LogID))
+	require.NoError(t, plain.Put(ctx, 1, storage.ObjectCheckpoint, resealed, false))
+	_, err = os.Stat(fsstorage.ChecksumPath(checkpointPath))
+	assert.ErrorIs(t, err, os.ErrNotExist, "the sidecar would no longer match")
+
+	// so the new content is unchecked, rather than corrupt
+	store, err = fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{Checksums: true, LazySelect: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	data, err := store.CheckpointRead(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, resealed, data)
+	result, err := store.Scrub(ctx, l.LogID)
+	require.NoError(t, err)
+	assert.Empty(t, result.Corrupt)
+	assert.Equal(t, []string{checkpointPath}, result.Unchecked)
+
+	// and an exclusive Put of an existing object keeps its sidecar
+	require.Error(t, store.Put(ctx, 0, storage.ObjectCheckpoint, l.Checkpoints[0], true))
+	_, err = os.Stat(fsstorage.ChecksumPath(l.path(t, store, 0, storage.ObjectCheckpoint)))
+	require.NoError(t, err)
+}
+
+func TestChecksums_unsetWritesNoSidecars(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{}, 1)
+
+	result, err := store.Scrub(ctx, l.LogID)
+	require.NoError(t, err)
+	assert.Zero(t, result.Checked)
+	assert.Len(t, result.Unchecked, 2)
+}
+
+// sidecarCounter counts the checksum sidecars opened
+type sidecarCounter struct {
+	fsstorage.Opener
+	opens int
+}
+
+func (o *sidecarCounter) Open(name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, fsstorage.ChecksumExt) {
+		o.opens++
+	}
+	return o.Opener.Open(name)
+}
+
+func TestChecksums_cachedForPartialReads(t *testing.T) {
+	ctx := t.Context()
+	l, writer := newTestLog(t, fsstorage.FSOptions{Checksums: true}, 2)
+	massifPath := l.path(t, writer, 1, storage.ObjectMassifData)
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(massifPath, old, old))
+
+	counter := &sidecarCounter{Opener: fsstorage.NewFileOpener()}
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{Checksums: true, LazySelect: true, ReadOpener: counter}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	opens := counter.opens
+	size := len(l.Massifs[1])
+	for n := size / 4; n <= size; n += size / 4 {
+		data, err := store.MassifReadN(ctx, 1, n)
+		require.NoError(t, err)
+		assert.Equal(t, l.Massifs[1][:n], data)
+	}
+	assert.Equal(t, opens+1, counter.opens)
+
+	// the massif changes, keeping its size, so the sidecar is read again
+	corrupt := append([]byte(nil), l.Massifs[1]...)
+	corrupt[size-1] ^= 0xff
+	require.NoError(t, os.WriteFile(massifPath, corrupt, 0644))
+	require.NoError(t, os.Chtimes(massifPath, old.Add(time.Second), old.Add(time.Second)))
+	_, err = store.MassifReadN(ctx, 1, size)
+	assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+	assert.Equal(t, opens+2, counter.opens)
+}
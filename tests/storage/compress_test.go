@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressSealed_readsTransparently(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{CompressSealed: true}, 3)
+
+	for massifIndex := range uint32(2) {
+		plain := l.path(t, store, massifIndex, storage.ObjectMassifData)
+		_, err := os.Stat(plain)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		info, err := os.Stat(plain + fsstorage.CompressedExt)
+		require.NoError(t, err)
+		assert.Less(t, info.Size(), int64(len(l.Massifs[massifIndex])))
+	}
+	// the head massif has a checkpoint, but is not sealed until the log moves on
+	_, err := os.Stat(l.path(t, store, 2, storage.ObjectMassifData))
+	require.NoError(t, err)
+
+	for _, lazy := range []bool{false, true} {
+		// compressed and plain massifs are both discovered
+		store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{LazySelect: lazy}))
+		require.NoError(t, err)
+		require.NoError(t, store.SelectLog(ctx, l.LogID))
+		health, err := store.Health()
+		require.NoError(t, err)
+		assert.True(t, health.Healthy(), health.String())
+		head, err := store.HeadIndex(ctx, storage.ObjectMassifData)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2), head)
+
+		start, err := store.MassifStart(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), start.MassifIndex)
+		for massifIndex, want := range l.Massifs {
+			data, err := store.MassifReadN(ctx, uint32(massifIndex), -1)
+			require.NoError(t, err)
+			assert.Equal(t, want, data)
+		}
+		data, err := store.MassifReadAt(ctx, 0, massifs.StartHeaderSize, massifs.ValueBytes)
+		require.NoError(t, err)
+		assert.Equal(t, l.Massifs[0][massifs.StartHeaderSize:massifs.StartHeaderSize+massifs.ValueBytes], data)
+	}
+}
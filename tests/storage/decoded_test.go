@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoded_invalidatedWhenReplaced(t *testing.T) {
+	ctx := t.Context()
+	l, store := newTestLog(t, fsstorage.FSOptions{}, 2)
+
+	start, err := store.MassifStart(ctx, 1)
+	require.NoError(t, err)
+	again, err := store.MassifStart(ctx, 1)
+	require.NoError(t, err)
+	assert.Same(t, start, again, "the decoded header is cached")
+
+	// putting the massif data again drops the decoded header
+	require.NoError(t, store.Put(ctx, 1, storage.ObjectMassifData, l.Massifs[1], false))
+	again, err = store.MassifStart(ctx, 1)
+	require.NoError(t, err)
+	assert.NotSame(t, start, again)
+	assert.Equal(t, start.MassifIndex, again.MassifIndex)
+
+	checkpt, err := store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+
+	// as does putting a new checkpoint
+	state := checkpt.MMRState
+	state.Timestamp = time.Now().Add(time.Second).UnixMilli()
+	data, err := l.checkpoint(state)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, 1, storage.ObjectCheckpoint, data, false))
+	replaced, err := store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, state.Timestamp, replaced.MMRState.Timestamp)
+
+	// and re-reading a checkpoint changed on disk
+	state.Timestamp++
+	data, err = l.checkpoint(state)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(l.path(t, store, 1, storage.ObjectCheckpoint), data, 0o644))
+	read, err := store.CheckpointRead(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	replaced, err = store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, state.Timestamp, replaced.MMRState.Timestamp)
+	assert.Equal(t, checkpt.MMRState.MMRSize, replaced.MMRState.MMRSize)
+}
+
+func TestDecoded_checkedForChangesByOtherWriters(t *testing.T) {
+	ctx := t.Context()
+	l, writer := newTestLog(t, fsstorage.FSOptions{}, 2)
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{StaleCheckInterval: time.Nanosecond}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	checkpt, err := store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+
+	// another writer replaces the checkpoint
+	state := checkpt.MMRState
+	state.Timestamp = time.Now().Add(time.Second).UnixMilli()
+	data, err := l.checkpoint(state)
+	require.NoError(t, err)
+	require.NoError(t, writer.Put(ctx, 1, storage.ObjectCheckpoint, data, false))
+
+	replaced, err := store.Checkpoint(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, state.Timestamp, replaced.MMRState.Timestamp)
+}
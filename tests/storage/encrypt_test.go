@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// testChunkSize is small, so reads of a massif span several chunks
+	testChunkSize = 64
+	// testSealedChunkSize is the size of a full chunk on disk, with its tag
+	testSealedChunkSize = testChunkSize + 16
+	// testEncryptedHeaderSize is the magic, chunk size and salt
+	testEncryptedHeaderSize = 8 + 4 + 32
+)
+
+func newKeyFileProvider(t *testing.T) *fsstorage.KeyFileProvider {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, fsstorage.GenerateKeyFile(keyFile))
+	assert.Error(t, fsstorage.GenerateKeyFile(keyFile), "an existing key file is never replaced")
+	keys, err := fsstorage.NewKeyFileProvider(keyFile)
+	require.NoError(t, err)
+	return keys
+}
+
+// newEncryptedTestLog returns a test log written with a new key, in chunks
+// of testChunkSize
+func newEncryptedTestLog(t *testing.T, fsopts fsstorage.FSOptions, massifCount uint32) (*testLog, *fsstorage.CachingStore) {
+	t.Helper()
+	keys := newKeyFileProvider(t)
+	writeOpener := fsstorage.NewEncryptingWriteOpener(fsstorage.NewDefaultWriteOpener(0644), keys)
+	writeOpener.ChunkSize = testChunkSize
+	fsopts.Keys, fsopts.WriteOpener = keys, writeOpener
+	return newTestLog(t, fsopts, massifCount)
+}
+
+// requireDecryptFails checks reads of massif 0, in full and of a range, fail
+// to decrypt. Eagerly selecting the log may fail first, reading the start
+// header of the head massif.
+func requireDecryptFails(t *testing.T, l *testLog, opts fsstorage.Options) {
+	t.Helper()
+	store, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+	if err = store.SelectLog(t.Context(), l.LogID); err != nil {
+		require.False(t, opts.LazySelect)
+		assert.ErrorIs(t, err, fsstorage.ErrDecrypt)
+		return
+	}
+	_, err = store.MassifReadN(t.Context(), 0, -1)
+	assert.ErrorIs(t, err, fsstorage.ErrDecrypt)
+	// spans the first and second chunks
+	_, err = store.MassifReadAt(t.Context(), 0, testChunkSize-4, 8)
+	assert.ErrorIs(t, err, fsstorage.ErrDecrypt)
+}
+
+func TestEncryption_roundTrip(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		name := "eager"
+		if lazy {
+			name = "lazy"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := t.Context()
+			l, writer := newEncryptedTestLog(t, fsstorage.FSOptions{}, 3)
+
+			raw, err := os.ReadFile(l.path(t, writer, 0, storage.ObjectMassifData))
+			require.NoError(t, err)
+			assert.False(t, bytes.Contains(raw, l.Massifs[0][:massifs.StartHeaderSize]), "the content is encrypted on disk")
+
+			opts := l.Options(fsstorage.FSOptions{Keys: writer.Opts.Keys, LazySelect: lazy})
+			store, err := fsstorage.NewStore(ctx, opts)
+			require.NoError(t, err)
+			require.NoError(t, store.SelectLog(ctx, l.LogID))
+
+			head, err := store.HeadIndex(ctx, storage.ObjectCheckpoint)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(len(l.Checkpoints)-1), head)
+			for i := range l.Massifs {
+				massifIndex := uint32(i)
+				start, err := store.MassifStart(ctx, massifIndex)
+				require.NoError(t, err)
+				assert.Equal(t, massifIndex, start.MassifIndex)
+
+				want := l.Massifs[i]
+				offset, length := int64(testChunkSize-massifs.ValueBytes/2), int64(2*massifs.ValueBytes)
+				data, err := store.MassifReadAt(ctx, massifIndex, offset, length)
+				require.NoError(t, err)
+				assert.Equal(t, want[offset:offset+length], data)
+
+				data, err = store.MassifReadN(ctx, massifIndex, -1)
+				require.NoError(t, err)
+				assert.Equal(t, want, data)
+				data, err = store.CheckpointRead(ctx, massifIndex)
+				require.NoError(t, err)
+				assert.Equal(t, l.Checkpoints[i], data)
+			}
+
+			// a different key can not read the log
+			opts.Keys = newKeyFileProvider(t)
+			requireDecryptFails(t, l, opts)
+		})
+	}
+}
+
+func TestEncryption_detectsTampering(t *testing.T) {
+	l, writer := newEncryptedTestLog(t, fsstorage.FSOptions{}, 2)
+	massifPath := l.path(t, writer, 0, storage.ObjectMassifData)
+	raw, err := os.ReadFile(massifPath)
+	require.NoError(t, err)
+	require.Greater(t, len(raw), testEncryptedHeaderSize+2*testSealedChunkSize)
+
+	opts := l.Options(fsstorage.FSOptions{Keys: writer.Opts.Keys, LazySelect: true})
+	flipped := bytes.Clone(raw)
+	flipped[testEncryptedHeaderSize+testChunkSize-2] ^= 0xff
+	salted := bytes.Clone(raw)
+	salted[testEncryptedHeaderSize-1] ^= 0xff
+	for name, tampered := range map[string][]byte{
+		"flipped": flipped,
+		// the salt selects the key for the file
+		"salt": salted,
+		// at a chunk boundary, so only the missing last chunk reveals it
+		"truncated": raw[:testEncryptedHeaderSize+2*testSealedChunkSize],
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(massifPath, tampered, 0644))
+			requireDecryptFails(t, l, opts)
+		})
+	}
+}
+
+func TestEncryption_filesAreBoundToTheirNames(t *testing.T) {
+	l, writer := newEncryptedTestLog(t, fsstorage.FSOptions{}, 3)
+	opts := l.Options(fsstorage.FSOptions{Keys: writer.Opts.Keys, LazySelect: true})
+
+	// massif 1, encrypted with the same log key, renamed to massif 0
+	raw, err := os.ReadFile(l.path(t, writer, 1, storage.ObjectMassifData))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(l.path(t, writer, 0, storage.ObjectMassifData), raw, 0644))
+	requireDecryptFails(t, l, opts)
+
+	// as is a checkpoint copied to the name of another
+	raw, err = os.ReadFile(l.path(t, writer, 1, storage.ObjectCheckpoint))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(l.path(t, writer, 0, storage.ObjectCheckpoint), raw, 0644))
+	store, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	_, err = store.CheckpointRead(t.Context(), 0)
+	assert.ErrorIs(t, err, fsstorage.ErrDecrypt)
+}
+
+func TestEncryption_rereadsChangedMassifsInFull(t *testing.T) {
+	ctx := t.Context()
+	l, writer := newEncryptedTestLog(t, fsstorage.FSOptions{}, 2)
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{
+		Keys: writer.Opts.Keys, LazySelect: true, StaleCheckInterval: time.Nanosecond,
+	}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	data, err := store.MassifReadN(ctx, 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[1], data)
+
+	// the massif grows, as the head massif does when leaves are added
+	grown := append(bytes.Clone(l.Massifs[1]), make([]byte, massifs.ValueBytes)...)
+	require.NoError(t, writer.Put(ctx, 1, storage.ObjectMassifData, grown, false))
+
+	// the whole massif was cached, so the whole massif is re-read, whatever
+	// the size of the encrypted file
+	data, ok, err := store.MassifData(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, grown, data)
+}
+
+// recordingKeys records the logs whose data keys are requested
+type recordingKeys struct {
+	fsstorage.KeyProvider
+	mu   sync.Mutex
+	logs map[string]bool
+}
+
+func (k *recordingKeys) DataKey(logID storage.LogID) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.logs == nil {
+		k.logs = make(map[string]bool)
+	}
+	k.logs[hex.EncodeToString(logID)] = true
+	return k.KeyProvider.DataKey(logID)
+}
+
+func TestEncryption_usesTheSelectedLog(t *testing.T) {
+	ctx := t.Context()
+	// the root dir is itself below the directory of another log
+	other := uuid.New()
+	rootDir := filepath.Join(t.TempDir(), fsstorage.LogIDPrefix, other.String(), "root")
+	keys := &recordingKeys{KeyProvider: newKeyFileProvider(t)}
+	l, writer := newTestLog(t, fsstorage.FSOptions{
+		RootDir: rootDir, CreateRootDir: true, Keys: keys, WriteOpener: fsstorage.NewEncryptingWriteOpener(fsstorage.NewDefaultWriteOpener(0644), keys),
+	}, 2)
+
+	store, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{RootDir: rootDir, Keys: keys}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	data, err := store.MassifReadN(ctx, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[0], data)
+	assert.Equal(t, map[string]bool{hex.EncodeToString(l.LogID): true}, keys.logs)
+
+	// a massif file outside any layout is read as part of the selected log
+	massifFile := filepath.Join(t.TempDir(), filepath.Base(l.path(t, writer, 0, storage.ObjectMassifData)))
+	raw, err := os.ReadFile(l.path(t, writer, 0, storage.ObjectMassifData))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(massifFile, raw, 0644))
+	opts := l.Options(fsstorage.FSOptions{Keys: keys, MassifFile: massifFile})
+	opts.RootDir = ""
+	store, err = fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, l.LogID))
+	data, err = store.MassifReadN(ctx, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[0], data)
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth_reportsGapsAndOrphanedCheckpoints(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	logDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String())
+	massifsDir := filepath.Join(logDir, fsstorage.MassifsDirName)
+	checkpointsDir := filepath.Join(logDir, fsstorage.CheckpointsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	require.NoError(t, os.MkdirAll(checkpointsDir, 0755))
+	for _, i := range []int{0, 3} {
+		name := fmt.Sprintf("%016d%s", i, fsstorage.DefaultMassifExt)
+		require.NoError(t, os.WriteFile(filepath.Join(massifsDir, name), []byte("not read"), 0644))
+	}
+	for _, i := range []int{0, 5} {
+		name := fmt.Sprintf("%016d%s", i, fsstorage.DefaultSealExt)
+		require.NoError(t, os.WriteFile(filepath.Join(checkpointsDir, name), []byte("not read"), 0644))
+	}
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, LazySelect: true}}
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, logID))
+
+	health, err := store.Health()
+	require.NoError(t, err)
+	assert.False(t, health.Healthy())
+	assert.Equal(t, []fsstorage.IndexRange{{First: 1, Last: 2}}, health.MissingMassifs)
+	assert.Equal(t, []uint32{5}, health.OrphanedCheckpoints)
+	assert.Empty(t, health.Duplicates)
+	assert.Equal(t, "missing massifs [1-2], checkpoints without massifs [5]", health.String())
+
+	// the same log fails selection if unhealthy logs are refused
+	opts.FailUnhealthy = true
+	store, err = fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	err = store.SelectLog(ctx, logID)
+	require.ErrorIs(t, err, fsstorage.ErrUnhealthy)
+	var unhealthy *fsstorage.UnhealthyLogError
+	require.ErrorAs(t, err, &unhealthy)
+	assert.Equal(t, []fsstorage.IndexRange{{First: 1, Last: 2}}, unhealthy.Health.MissingMassifs)
+	assert.Nil(t, store.Selected)
+}
+
+func TestHealth_reportsLargeGapsAsRanges(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	id := uuid.New()
+
+	massifsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	for _, i := range []uint32{0, 2, 1 << 31, ^uint32(0)} {
+		name := fmt.Sprintf("%016d%s", i, fsstorage.DefaultMassifExt)
+		require.NoError(t, os.WriteFile(filepath.Join(massifsDir, name), []byte("not read"), 0644))
+	}
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, LazySelect: true}}
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, storage.LogID(id[:])))
+
+	health, err := store.Health()
+	require.NoError(t, err)
+	assert.Equal(t, []fsstorage.IndexRange{
+		{First: 1, Last: 1}, {First: 3, Last: 1<<31 - 1}, {First: 1<<31 + 1, Last: ^uint32(0) - 1},
+	}, health.MissingMassifs)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexFromPath(t *testing.T) {
+	massifIndex, ok := fsstorage.IndexFromPath("/a/massifs/0000000000000012.log", fsstorage.DefaultMassifExt)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(12), massifIndex)
+
+	for _, p := range []string{
+		"/a/massifs/0000000000000012.sth",
+		"/a/massifs/.log",
+		"/a/massifs/00x0.log",
+		"/a/massifs/99999999999999999999.log",
+	} {
+		_, ok = fsstorage.IndexFromPath(p, fsstorage.DefaultMassifExt)
+		assert.False(t, ok, p)
+	}
+}
+
+func TestLazySelect_doesNotReadFiles(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	checkpointsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.CheckpointsDirName)
+	require.NoError(t, os.MkdirAll(checkpointsDir, 0755))
+	for _, name := range []string{"0000000000000003.sth", "0000000000000007.sth"} {
+		// the content is not a valid checkpoint, so an eager selection would fail
+		require.NoError(t, os.WriteFile(filepath.Join(checkpointsDir, name), []byte("not read"), 0644))
+	}
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, LazySelect: true}}
+	store, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), logID))
+
+	head, err := store.HeadIndex(t.Context(), storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), head)
+	assert.Equal(t, uint32(3), store.Selected.FirstSealIndex)
+	assert.Empty(t, store.Selected.CheckpointData)
+}
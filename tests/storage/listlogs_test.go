@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListLogs_paginatesAcrossLayouts(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+
+	// three logs in the neutral layout, written through the store
+	for range 3 {
+		id := uuid.New()
+		require.NoError(t, store.SelectLog(ctx, storage.LogID(id[:])))
+		require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+		require.NoError(t, store.Put(ctx, 2, storage.ObjectCheckpoint, []byte("seal 2"), true))
+	}
+	// and one in the datatrails layout
+	tenant := uuid.New()
+	massifsDir := filepath.Join(rootDir, fsstorage.DatatrailsLogIDPrefix, tenant.String(), fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(massifsDir, "0000000000000004.log"), make([]byte, 100), 0644))
+
+	var all []fsstorage.LogSummary
+	opts := fsstorage.ListLogsOptions{PageSize: 3}
+	for {
+		page, err := store.ListLogs(ctx, opts)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Logs), 3)
+		all = append(all, page.Logs...)
+		if page.NextPageToken == "" {
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	require.Len(t, all, 4)
+
+	for _, summary := range all[:3] {
+		assert.Equal(t, 2, summary.SealCount)
+		assert.Equal(t, uint32(2), summary.HeadSealIndex)
+		assert.Equal(t, int64(12), summary.Bytes)
+	}
+	last := all[3]
+	assert.Equal(t, storage.LogID(tenant[:]), last.LogID)
+	assert.Equal(t, 1, last.MassifCount)
+	assert.Equal(t, uint32(4), last.HeadMassifIndex)
+	assert.Equal(t, int64(100), last.Bytes)
+}
+
+func TestListLogs_continuesAcrossChanges(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+
+	logsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix)
+	addLog := func(name string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(logsDir, name, fsstorage.CheckpointsDirName), 0755))
+		// an old modification time, so the listing is re-used until the directory changes again
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(logsDir, old, old))
+	}
+	addLog("00000000-0000-0000-0000-000000000001")
+	addLog("00000000-0000-0000-0000-000000000003")
+
+	page, err := store.ListLogs(ctx, fsstorage.ListLogsOptions{PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, page.Logs, 1)
+	require.NotEmpty(t, page.NextPageToken)
+
+	// logs added between pages are listed if they sort after the token
+	addLog("00000000-0000-0000-0000-000000000002")
+	addLog("00000000-0000-0000-0000-000000000000")
+	page, err = store.ListLogs(ctx, fsstorage.ListLogsOptions{PageSize: 3, PageToken: page.NextPageToken})
+	require.NoError(t, err)
+	var names []string
+	for _, summary := range page.Logs {
+		names = append(names, filepath.Base(summary.Dir))
+	}
+	assert.Equal(t, []string{
+		"00000000-0000-0000-0000-000000000002", "00000000-0000-0000-0000-000000000003",
+	}, names)
+	assert.Empty(t, page.NextPageToken)
+}
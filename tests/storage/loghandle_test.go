@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogHandle_concurrentLogs(t *testing.T) {
+	ctx := t.Context()
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: t.TempDir()}})
+	require.NoError(t, err)
+
+	const logs = 4
+	const seals = 8
+	handles := make([]*fsstorage.LogHandle, logs)
+	for i := range handles {
+		id := uuid.New()
+		handles[i], err = store.Log(ctx, storage.LogID(id[:]))
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, logs*seals)
+	for _, h := range handles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range uint32(seals) {
+				errs <- h.Put(ctx, i, storage.ObjectCheckpoint, h.LogID(), true)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	for _, h := range handles {
+		head, err := h.HeadIndex(ctx, storage.ObjectCheckpoint)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(seals-1), head)
+
+		data, ok, err := h.CheckpointData(seals - 1)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, []byte(h.LogID()), data)
+	}
+}
+
+func TestLogHandle_waitingForALockDoesNotBlockOtherLogs(t *testing.T) {
+	ctx := t.Context()
+	rootDir := t.TempDir()
+	newStore := func() *fsstorage.CachingStore {
+		store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{
+			RootDir: rootDir, WriterLock: fsstorage.WriterLockOnSelect,
+		}})
+		require.NoError(t, err)
+		return store
+	}
+	locked, free := uuid.New(), uuid.New()
+
+	holder := newStore()
+	require.NoError(t, holder.SelectLog(ctx, storage.LogID(locked[:])))
+	defer holder.Close()
+
+	store := newStore()
+	defer store.Close()
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() {
+		_, err := store.Log(waitCtx, storage.LogID(locked[:]))
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the other log is usable while the first waits for its lock
+	h, err := store.Log(ctx, storage.LogID(free[:]))
+	require.NoError(t, err)
+	require.NoError(t, h.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+	select {
+	case err := <-waited:
+		t.Fatalf("the lock wait ended early: %v", err)
+	default:
+	}
+	assert.ErrorIs(t, <-waited, fsstorage.ErrLockHeld)
+}
+
+func TestSelectLog_failedPopulationIsNotCached(t *testing.T) {
+	ctx := t.Context()
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+
+	// a file in place of the checkpoint directory fails the listing
+	dir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.CheckpointsDirName)
+	require.NoError(t, os.MkdirAll(filepath.Dir(dir), 0o755))
+	require.NoError(t, os.WriteFile(dir, []byte("not a directory"), 0o644))
+
+	require.Error(t, store.SelectLog(ctx, logID))
+	assert.NotContains(t, store.Logs, string(logID))
+	require.Error(t, store.SelectLog(ctx, logID), "the failed population is not re-used")
+
+	require.NoError(t, os.Remove(dir))
+	require.NoError(t, store.SelectLog(ctx, logID))
+	assert.Contains(t, store.Logs, string(logID))
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheBudget_evictsLeastRecentlyUsed(t *testing.T) {
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: t.TempDir(), CacheBudget: 10}}
+	store, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+
+	ctx := t.Context()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	require.NoError(t, store.SelectLog(ctx, logID))
+
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("aaaaaa"), true))
+	require.NoError(t, store.Put(ctx, 1, storage.ObjectCheckpoint, []byte("bbbbbb"), true))
+	assert.Equal(t, int64(6), store.CachedBytes())
+	assert.NotContains(t, store.Selected.CheckpointData, store.Selected.MassifPaths[0].Checkpoint)
+
+	// the evicted data is re-read transparently, evicting the other checkpoint in turn
+	data, ok, err := store.CheckpointData(0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []byte("aaaaaa"), data)
+	assert.Equal(t, int64(6), store.CachedBytes())
+	assert.NotContains(t, store.Selected.CheckpointData, store.Selected.MassifPaths[1].Checkpoint)
+
+	store.EvictLog(logID)
+	assert.Nil(t, store.Selected)
+	assert.Empty(t, store.Logs)
+	assert.Equal(t, int64(0), store.CachedBytes())
+}
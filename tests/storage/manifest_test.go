@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backdateLogDirs sets the modification times of the massifs and checkpoints
+// directories of the selected log well in the past, so that a listing made
+// now is trusted by the manifest it saves.
+func backdateLogDirs(t *testing.T, store *fsstorage.CachingStore) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	for _, ty := range []storage.ObjectType{storage.ObjectMassifData, storage.ObjectCheckpoint} {
+		dir, err := store.PrefixPath(ty)
+		require.NoError(t, err)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		require.NoError(t, os.Chtimes(dir, old, old))
+	}
+}
+
+// readManifest returns the manifest saved for the selected log
+func readManifest(t *testing.T, store *fsstorage.CachingStore) (string, *fsstorage.LogManifest) {
+	t.Helper()
+	logDir, err := store.LogDirPath()
+	require.NoError(t, err)
+	manifestPath := filepath.Join(logDir, fsstorage.ManifestFileName)
+	data, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	m := &fsstorage.LogManifest{}
+	require.NoError(t, json.Unmarshal(data, m))
+	return manifestPath, m
+}
+
+func TestManifest_selectsWithoutReading(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, UseManifest: true}}
+
+	writer, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(t.Context(), logID))
+	require.NoError(t, writer.Put(t.Context(), 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+	require.NoError(t, writer.Put(t.Context(), 1, storage.ObjectCheckpoint, []byte("seal 1"), true))
+
+	assert.FileExists(t, filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.ManifestFileName))
+	require.NotNil(t, writer.Selected.Manifest)
+	require.Len(t, writer.Selected.Manifest.Checkpoints, 2)
+	assert.Equal(t, "0000000000000001.sth", writer.Selected.Manifest.Checkpoints[1].Name)
+
+	// The writes were too recent for the manifest to be trusted. A lazy
+	// listing, made well after them, rebuilds it.
+	backdateLogDirs(t, writer)
+	lister, err := fsstorage.NewStore(t.Context(), fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir: rootDir, UseManifest: true, LazySelect: true,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, lister.SelectLog(t.Context(), logID))
+
+	// The checkpoint content is not valid, so this only succeeds if the
+	// manifest is used instead of reading the files.
+	reader, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(t.Context(), logID))
+	assert.Equal(t, uint32(1), reader.Selected.HeadSealIndex)
+	assert.Empty(t, reader.Selected.CheckpointData)
+}
+
+// createAfterListing lists files, and then creates a file, once, as another
+// writer might while the listing is being turned into a manifest.
+type createAfterListing struct {
+	fsstorage.DirLister
+	dir, path string
+}
+
+func (l *createAfterListing) ListFiles(dir string) ([]string, error) {
+	files, err := l.DirLister.ListFiles(dir)
+	if err == nil && dir == l.dir && l.path != "" {
+		err = os.WriteFile(l.path, []byte("seal 1"), 0644)
+		l.path = ""
+	}
+	return files, err
+}
+
+func TestManifest_findsFilesCreatedWhileListing(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	ctx := t.Context()
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, UseManifest: true, LazySelect: true}}
+
+	writer, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+	sealsDir, err := writer.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	backdateLogDirs(t, writer)
+
+	listerOpts := opts
+	listerOpts.DirLister = &createAfterListing{
+		DirLister: fsstorage.NewDirLister(), dir: sealsDir, path: filepath.Join(sealsDir, "0000000000000001.sth"),
+	}
+	lister, err := fsstorage.NewStore(ctx, listerOpts)
+	require.NoError(t, err)
+	require.NoError(t, lister.SelectLog(ctx, logID))
+	assert.Equal(t, uint32(0), lister.Selected.HeadSealIndex)
+
+	// The manifest records the directory times from before the listing, so
+	// it is out of date, and the next select lists the new file
+	reader, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(ctx, logID))
+	assert.Equal(t, uint32(1), reader.Selected.HeadSealIndex)
+}
+
+func TestManifest_distrustsListingsWithinTheMTimeGranularity(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	ctx := t.Context()
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, UseManifest: true, LazySelect: true}}
+
+	writer, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+	backdateLogDirs(t, writer)
+	lister, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, lister.SelectLog(ctx, logID))
+
+	// another writer creates a file in the same modification time tick as
+	// the listing
+	sealsDir, err := writer.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(sealsDir, "0000000000000001.sth"), []byte("seal 1"), 0644))
+	manifestPath, m := readManifest(t, lister)
+	mtime := time.Unix(0, m.SealsMTime)
+	require.NoError(t, os.Chtimes(sealsDir, mtime, mtime))
+
+	selectHead := func(listedAt time.Time) uint32 {
+		m.ListedAt = listedAt.UnixNano()
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(manifestPath, data, 0644))
+		reader, err := fsstorage.NewStore(ctx, opts)
+		require.NoError(t, err)
+		require.NoError(t, reader.SelectLog(ctx, logID))
+		return reader.Selected.HeadSealIndex
+	}
+	// a listing made well after the modification time is trusted
+	assert.Equal(t, uint32(0), selectHead(mtime.Add(time.Hour)))
+	assert.Equal(t, uint32(1), selectHead(mtime))
+}
+
+func TestManifest_checksSealedContent(t *testing.T) {
+	ctx := t.Context()
+	l, writer := newTestLog(t, fsstorage.FSOptions{UseManifest: true}, 3)
+
+	m := writer.Selected.Manifest
+	require.NotNil(t, m)
+	require.NotEmpty(t, m.Massifs)
+	sum := sha256.Sum256(l.Massifs[0])
+	assert.Equal(t, int64(len(l.Massifs[0])), m.Massifs[0].Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), m.Massifs[0].SHA256)
+	sum = sha256.Sum256(l.Checkpoints[0])
+	assert.Equal(t, hex.EncodeToString(sum[:]), m.Checkpoints[0].SHA256)
+	// the head massif still grows in place
+	assert.Empty(t, m.Massifs[len(m.Massifs)-1].SHA256)
+
+	// saved by a listing well after the writes
+	backdateLogDirs(t, writer)
+	require.NoError(t, writer.PopulateCache(ctx))
+	_, saved := readManifest(t, writer)
+	assert.Equal(t, m.Massifs[0].SHA256, saved.Massifs[0].SHA256)
+
+	// massif 0 is changed in place, keeping its size and modification time
+	massifPath := l.path(t, writer, 0, storage.ObjectMassifData)
+	info, err := os.Stat(massifPath)
+	require.NoError(t, err)
+	raw, err := os.ReadFile(massifPath)
+	require.NoError(t, err)
+	raw[len(raw)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(massifPath, raw, 0644))
+	require.NoError(t, os.Chtimes(massifPath, info.ModTime(), info.ModTime()))
+
+	reader, err := fsstorage.NewStore(ctx, l.Options(fsstorage.FSOptions{UseManifest: true}))
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(ctx, l.LogID))
+	require.NotNil(t, reader.Selected.Manifest)
+	_, err = reader.MassifReadN(ctx, 0, -1)
+	assert.ErrorIs(t, err, fsstorage.ErrCorrupt)
+	data, err := reader.MassifReadN(ctx, 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[1], data)
+}
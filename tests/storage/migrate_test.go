@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDatatrailsTestLog returns a test log written in the datatrails layout,
+// and a store using the default layout to migrate it to.
+func newDatatrailsTestLog(t *testing.T, massifCount uint32) (*testLog, *fsstorage.CachingStore, *fsstorage.CachingStore) {
+	l, writer := newTestLog(t, fsstorage.FSOptions{PrefixProvider: fsstorage.NewDatatrailsPrefixProvider()}, massifCount)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{}))
+	require.NoError(t, err)
+	return l, writer, store
+}
+
+// requireMigrated checks the log reads back in the layout of the store
+func requireMigrated(t *testing.T, l *testLog, store *fsstorage.CachingStore) {
+	t.Helper()
+	reader, err := fsstorage.NewStore(t.Context(), store.Opts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(t.Context(), l.LogID))
+	for i := range l.Massifs {
+		data, err := reader.MassifReadN(t.Context(), uint32(i), -1)
+		require.NoError(t, err)
+		assert.Equal(t, l.Massifs[i], data)
+		data, err = reader.CheckpointRead(t.Context(), uint32(i))
+		require.NoError(t, err)
+		assert.Equal(t, l.Checkpoints[i], data)
+	}
+}
+
+func TestMigrate_dryRunChangesNothing(t *testing.T) {
+	ctx := t.Context()
+	l, writer, store := newDatatrailsTestLog(t, 1)
+	sources := []string{
+		l.path(t, writer, 0, storage.ObjectMassifData),
+		l.path(t, writer, 0, storage.ObjectCheckpoint),
+	}
+
+	result, err := store.Migrate(ctx, fsstorage.MigrateOptions{
+		From:   fsstorage.NewDatatrailsPrefixProvider(),
+		Mode:   fsstorage.MigrateMove,
+		DryRun: true,
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Items, 2)
+	assert.Equal(t, 2, result.Count(fsstorage.MigrateTransferred), "%v", result.Items)
+
+	_, err = os.Stat(filepath.Join(l.TC.Cfg.RootDir, fsstorage.LogIDPrefix))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	for _, source := range sources {
+		assert.FileExists(t, source)
+	}
+
+	// migrating a layout onto itself is refused
+	_, err = store.Migrate(ctx, fsstorage.MigrateOptions{
+		From: fsstorage.NewDatatrailsPrefixProvider(),
+		To:   fsstorage.NewDatatrailsPrefixProvider(),
+	})
+	assert.Error(t, err)
+}
+
+func TestMigrate_linkLeavesTheSource(t *testing.T) {
+	l, writer, store := newDatatrailsTestLog(t, 2)
+
+	result, err := store.Migrate(t.Context(), fsstorage.MigrateOptions{From: fsstorage.NewDatatrailsPrefixProvider()})
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Count(fsstorage.MigrateTransferred), "%v", result.Items)
+	requireMigrated(t, l, store)
+	assert.FileExists(t, l.path(t, writer, 1, storage.ObjectMassifData))
+	assert.FileExists(t, l.path(t, writer, 1, storage.ObjectCheckpoint))
+
+	// running it again finds everything in place
+	result, err = store.Migrate(t.Context(), fsstorage.MigrateOptions{From: fsstorage.NewDatatrailsPrefixProvider()})
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Count(fsstorage.MigrateAlreadyPresent), "%v", result.Items)
+}
+
+func TestMigrate_moveResumes(t *testing.T) {
+	l, writer, store := newDatatrailsTestLog(t, 2)
+	from := fsstorage.NewDatatrailsPrefixProvider()
+
+	// an interrupted run, which linked only the first massif
+	result, err := store.Migrate(t.Context(), fsstorage.MigrateOptions{From: from, LogIDs: []storage.LogID{l.LogID}})
+	require.NoError(t, err)
+	for _, item := range result.Items {
+		if item.MassifIndex != 0 || item.Type != storage.ObjectMassifData {
+			require.NoError(t, os.Remove(item.Target))
+		}
+	}
+
+	result, err = store.Migrate(t.Context(), fsstorage.MigrateOptions{From: from, Mode: fsstorage.MigrateMove})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count(fsstorage.MigrateAlreadyPresent), "%v", result.Items)
+	assert.Equal(t, 3, result.Count(fsstorage.MigrateTransferred), "%v", result.Items)
+	requireMigrated(t, l, store)
+	for i := range l.Massifs {
+		assert.NoFileExists(t, l.path(t, writer, uint32(i), storage.ObjectMassifData))
+		assert.NoFileExists(t, l.path(t, writer, uint32(i), storage.ObjectCheckpoint))
+	}
+}
+
+func TestMigrate_takesTheWriterLocks(t *testing.T) {
+	l, writer, _ := newDatatrailsTestLog(t, 1)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{WriterLockNoWait: true}))
+	require.NoError(t, err)
+	from := fsstorage.NewDatatrailsPrefixProvider()
+
+	// a writer in the source layout holds the lock
+	require.NoError(t, writer.TryLockLog())
+	_, err = store.Migrate(t.Context(), fsstorage.MigrateOptions{From: from, Mode: fsstorage.MigrateMove})
+	assert.ErrorIs(t, err, fsstorage.ErrLockHeld)
+	assert.FileExists(t, l.path(t, writer, 0, storage.ObjectMassifData))
+	require.NoError(t, writer.UnlockLog(l.LogID))
+
+	// as does one in the target layout
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	target, err := fsstorage.NewStore(t.Context(), store.Opts)
+	require.NoError(t, err)
+	require.NoError(t, target.SelectLog(t.Context(), l.LogID))
+	require.NoError(t, target.TryLockLog())
+	_, err = store.Migrate(t.Context(), fsstorage.MigrateOptions{From: from, Mode: fsstorage.MigrateMove})
+	assert.ErrorIs(t, err, fsstorage.ErrLockHeld)
+	assert.FileExists(t, l.path(t, writer, 0, storage.ObjectMassifData))
+	require.NoError(t, target.UnlockLog(l.LogID))
+
+	// a lock the migrating store holds itself is used
+	require.NoError(t, store.TryLockLog())
+	result, err := store.Migrate(t.Context(), fsstorage.MigrateOptions{From: from, Mode: fsstorage.MigrateMove})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count(fsstorage.MigrateTransferred), "%v", result.Items)
+	assert.NoFileExists(t, l.path(t, writer, 0, storage.ObjectMassifData))
+	requireMigrated(t, l, store)
+}
+
+func TestMigrate_reportsConflicts(t *testing.T) {
+	l, writer, store := newDatatrailsTestLog(t, 1)
+	source := l.path(t, writer, 0, storage.ObjectCheckpoint)
+
+	// the target already has a different checkpoint for the massif
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	target := l.path(t, store, 0, storage.ObjectCheckpoint)
+	other := []byte("another checkpoint")
+	require.NoError(t, os.MkdirAll(filepath.Dir(target), 0755))
+	require.NoError(t, os.WriteFile(target, other, 0644))
+
+	result, err := store.Migrate(t.Context(), fsstorage.MigrateOptions{
+		From: fsstorage.NewDatatrailsPrefixProvider(), Mode: fsstorage.MigrateMove})
+	require.NoError(t, err)
+	conflicts := result.Conflicts()
+	require.Len(t, conflicts, 1, "%v", result.Items)
+	assert.Equal(t, source, conflicts[0].Source)
+	assert.Equal(t, target, conflicts[0].Target)
+
+	// neither copy is changed
+	data, err := os.ReadFile(source)
+	require.NoError(t, err)
+	assert.Equal(t, l.Checkpoints[0], data)
+	data, err = os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, other, data)
+}
+
+func TestMigrate_encryptedFilesAreTransferredVerbatim(t *testing.T) {
+	l, writer := newEncryptedTestLog(t, fsstorage.FSOptions{PrefixProvider: fsstorage.NewDatatrailsPrefixProvider()}, 2)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{Keys: writer.Opts.Keys}))
+	require.NoError(t, err)
+
+	result, err := store.Migrate(t.Context(), fsstorage.MigrateOptions{
+		From: fsstorage.NewDatatrailsPrefixProvider(), Mode: fsstorage.MigrateMove})
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Count(fsstorage.MigrateTransferred), "%v", result.Items)
+	requireMigrated(t, l, store)
+
+	// the files are not encrypted again, and still decrypt under their new paths
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	raw, err := os.ReadFile(l.path(t, store, 0, storage.ObjectMassifData))
+	require.NoError(t, err)
+	assert.NotEqual(t, l.Massifs[0], raw)
+	assert.Len(t, raw, testEncryptedHeaderSize+len(l.Massifs[0])+
+		(len(l.Massifs[0])+testChunkSize-1)/testChunkSize*(testSealedChunkSize-testChunkSize))
+}
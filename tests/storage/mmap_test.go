@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmap_evictionWhileViewHeld(t *testing.T) {
+	l, _ := newTestLog(t, fsstorage.FSOptions{}, 3)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{
+		LazySelect: true, MmapSealed: true, CacheBudget: int64(len(l.Massifs[0])),
+	}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+
+	view0, release0, err := store.MassifView(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[0], view0)
+
+	// viewing the next sealed massif evicts the first, whose mapping is
+	// kept until it is released
+	view1, release1, err := store.MassifView(t.Context(), 1)
+	require.NoError(t, err)
+	assert.Len(t, store.Selected.MassifData, 1)
+	assert.Equal(t, l.Massifs[0], view0)
+	release0()
+	release0()
+
+	// as does closing the store
+	require.NoError(t, store.Close())
+	assert.Empty(t, store.Selected.MassifData)
+	assert.Equal(t, l.Massifs[1], view1)
+	release1()
+}
+
+func TestMmap_readsCopyOnlyWhatTheyReturn(t *testing.T) {
+	l, _ := newTestLog(t, fsstorage.FSOptions{}, 3)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{LazySelect: true, MmapSealed: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+
+	view, release, err := store.MassifView(t.Context(), 0)
+	require.NoError(t, err)
+	defer release()
+
+	// a partial read is a copy of just the bytes read
+	prefix, err := store.MassifReadN(t.Context(), 0, 8)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[0][:8], prefix)
+	prefix[0] ^= 0xff
+	assert.Equal(t, l.Massifs[0], view)
+
+	// the whole massif is copied once, and then served from the copy
+	data, err := store.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	again, ok, err := store.MassifData(0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, l.Massifs[0], again)
+	assert.Same(t, &data[0], &again[0])
+	assert.Equal(t, l.Massifs[0], view)
+}
+
+func TestMmap_failedPut(t *testing.T) {
+	l, _ := newTestLog(t, fsstorage.FSOptions{}, 3)
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{LazySelect: true, MmapSealed: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+
+	data, err := store.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// the mapping is released before the write, which then fails as the massif exists
+	require.Error(t, store.Put(t.Context(), 0, storage.ObjectMassifData, data, true))
+	assert.Equal(t, l.Massifs[0], data)
+
+	cached, ok, err := store.MassifData(0)
+	require.NoError(t, err)
+	if ok {
+		assert.Equal(t, l.Massifs[0], cached)
+	}
+	data, err = store.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[0], data)
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopulateCache_honorsCancellation(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+
+	checkpointsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.CheckpointsDirName)
+	require.NoError(t, os.MkdirAll(checkpointsDir, 0755))
+	for i := range 32 {
+		name := fmt.Sprintf("%016d%s", i, fsstorage.DefaultSealExt)
+		require.NoError(t, os.WriteFile(filepath.Join(checkpointsDir, name), []byte("not read"), 0644))
+	}
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, PopulateConcurrency: 4}}
+	store, err := fsstorage.NewStore(t.Context(), opts)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err = store.SelectLog(ctx, storage.LogID(id[:]))
+	require.ErrorIs(t, err, context.Canceled)
+}
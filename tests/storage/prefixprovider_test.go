@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixProvider_datatrailsBlobLayout(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir:        rootDir,
+		PrefixProvider: fsstorage.NewDatatrailsBlobPrefixProvider(),
+		LazySelect:     true,
+	}}
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	require.NoError(t, store.SelectLog(ctx, logID))
+	require.NoError(t, store.Put(ctx, 1, storage.ObjectCheckpoint, []byte("seal 1"), true))
+
+	sealsDir := filepath.Join(rootDir, "v1", "mmrs", "tenant", id.String(), "0", "massifseals")
+	entries, err := os.ReadDir(sealsDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// a new store with the same layout finds the checkpoint
+	store, err = fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, logID))
+	head, err := store.HeadIndex(ctx, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), head)
+
+	// and the log is listed whichever layout the listing store is configured with
+	store, err = fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+	page, err := store.ListLogs(ctx, fsstorage.ListLogsOptions{})
+	require.NoError(t, err)
+	require.Len(t, page.Logs, 1)
+	assert.Equal(t, logID, page.Logs[0].LogID)
+	assert.Equal(t, 1, page.Logs[0].SealCount)
+}
+
+func TestPrefixProvider_nonUUIDLogID(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	store, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+
+	logID := storage.LogID(bytes.Repeat([]byte{0xab}, 32))
+	require.NoError(t, store.SelectLog(ctx, logID))
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+
+	logDir, err := store.LogDirPath()
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(logID), filepath.Base(logDir))
+
+	parsed, err := fsstorage.StoragePath2EncodedLogID(filepath.Join(logDir, fsstorage.CheckpointsDirName, "0000000000000000.sth"))
+	require.NoError(t, err)
+	assert.Equal(t, logID, parsed)
+
+	page, err := store.ListLogs(ctx, fsstorage.ListLogsOptions{})
+	require.NoError(t, err)
+	require.Len(t, page.Logs, 1)
+	assert.Equal(t, logID, page.Logs[0].LogID)
+
+	// uuid log ids keep their existing directory names
+	id := uuid.New()
+	name, err := fsstorage.LogID2DirName(storage.LogID(id[:]))
+	require.NoError(t, err)
+	assert.Equal(t, id.String(), name)
+	parsed, err = fsstorage.DirName2LogID(name)
+	require.NoError(t, err)
+	assert.Equal(t, storage.LogID(id[:]), parsed)
+}
+
+func TestDirName2LogID_roundTrip(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		logID := storage.LogID(bytes.Repeat([]byte{byte(n)}, n))
+		name, err := fsstorage.LogID2DirName(logID)
+		require.NoError(t, err)
+		parsed, err := fsstorage.DirName2LogID(name)
+		require.NoError(t, err, "length %d", n)
+		assert.Equal(t, logID, parsed, "length %d", n)
+	}
+}
+
+func TestDirName2LogID_rejectsOtherEncodings(t *testing.T) {
+	id := uuid.New()
+	for _, name := range []string{
+		"",
+		strings.ToUpper(id.String()),
+		// the hex form of a 16 byte log id, which is named as a uuid
+		hex.EncodeToString(id[:]),
+		"ABCDEF",
+		"abc",
+		"{" + id.String() + "}",
+		"urn:uuid:" + id.String(),
+	} {
+		_, err := fsstorage.DirName2LogID(name)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeCache_mergesOverlappingRanges(t *testing.T) {
+	rc := &fsstorage.RangeCache{}
+	rc.Add(10, []byte("abcd"))
+	rc.Add(20, []byte("uvwx"))
+
+	_, ok := rc.Get(12, 10)
+	assert.False(t, ok, "the range spans a gap")
+
+	// adjoins the first range and overlaps the second
+	rc.Add(14, []byte("efghijUV"))
+	assert.Len(t, rc.Ranges, 1)
+
+	data, ok := rc.Get(12, 10)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("cdefghijUV"), data)
+
+	data, ok = rc.Get(22, 2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("wx"), data)
+
+	_, ok = rc.Get(22, 3)
+	assert.False(t, ok)
+}
+
+// countingOpener counts the files opened. It hides any random access
+// support of the inner opener, which countingReaderAtOpener exposes.
+type countingOpener struct {
+	inner fsstorage.Opener
+	opens int
+}
+
+func (o *countingOpener) Open(name string) (io.ReadCloser, error) {
+	o.opens++
+	return o.inner.Open(name)
+}
+
+type countingReaderAtOpener struct {
+	*countingOpener
+}
+
+func (o countingReaderAtOpener) OpenReaderAt(name string) (fsstorage.ReaderAtCloser, error) {
+	o.opens++
+	return o.inner.(fsstorage.ReaderAtOpener).OpenReaderAt(name)
+}
+
+func TestMassifReadAt(t *testing.T) {
+	for _, readerAt := range []bool{true, false} {
+		name := "sequential"
+		if readerAt {
+			name = "readerAt"
+		}
+		t.Run(name, func(t *testing.T) {
+			l, _ := newTestLog(t, fsstorage.FSOptions{}, 2)
+			counter := &countingOpener{inner: fsstorage.NewFileOpener()}
+			var opener fsstorage.Opener = counter
+			if readerAt {
+				opener = countingReaderAtOpener{counter}
+			}
+			store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{LazySelect: true, ReadOpener: opener}))
+			require.NoError(t, err)
+			require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+
+			want := l.Massifs[1]
+			offset, length := int64(len(want)-2*massifs.ValueBytes), int64(massifs.ValueBytes)
+			opens := counter.opens
+			data, err := store.MassifReadAt(t.Context(), 1, offset, length)
+			require.NoError(t, err)
+			assert.Equal(t, want[offset:offset+length], data)
+			// the massif was discovered from its file name, so its start
+			// header is read first, to check it
+			assert.Equal(t, opens+2, counter.opens)
+			assert.Len(t, store.Selected.MassifData[l.path(t, store, 1, storage.ObjectMassifData)], massifs.StartHeaderSize,
+				"a range is not the massif data")
+
+			// the result is a copy, so changing it does not change the cache
+			data[0] ^= 0xff
+			data, err = store.MassifReadAt(t.Context(), 1, offset+1, length-1)
+			require.NoError(t, err)
+			assert.Equal(t, want[offset+1:offset+length], data)
+			assert.Equal(t, opens+2, counter.opens, "served from the cached range")
+
+			// a range beyond the data
+			_, err = store.MassifReadAt(t.Context(), 1, int64(len(want)), 1)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMassifReadAt_checksLazilyDiscoveredMassifs(t *testing.T) {
+	l, writer := newTestLog(t, fsstorage.FSOptions{}, 2)
+	// massif 1 copied to the name of massif 0
+	raw, err := os.ReadFile(l.path(t, writer, 1, storage.ObjectMassifData))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(l.path(t, writer, 0, storage.ObjectMassifData), raw, 0644))
+
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{LazySelect: true}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	// the range does not include the start header
+	_, err = store.MassifReadAt(t.Context(), 0, int64(massifs.StartHeaderSize), massifs.ValueBytes)
+	assert.ErrorIs(t, err, fsstorage.ErrIndexMismatch)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecovery_orphanedTempFiles(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	massifsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	tmp := filepath.Join(massifsDir, ".0000000000000000.log.1234.1"+fsstorage.TempFileSuffix)
+	require.NoError(t, os.WriteFile(tmp, []byte("partial"), 0644))
+
+	newStore := func(policy fsstorage.RecoveryPolicy) *fsstorage.CachingStore {
+		opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, Recovery: policy}}
+		store, err := fsstorage.NewStore(t.Context(), opts)
+		require.NoError(t, err)
+		require.NoError(t, store.SelectLog(t.Context(), logID))
+		return store
+	}
+
+	store := newStore(fsstorage.RecoveryReport)
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	finding := store.Selected.RecoveryFindings[0]
+	assert.Equal(t, fsstorage.IssueTempFile, finding.Issue)
+	assert.Equal(t, fsstorage.ActionReported, finding.Action)
+	assert.FileExists(t, tmp)
+
+	// the file may belong to a write in progress while another owner holds the lock
+	writer, err := fsstorage.NewStore(t.Context(), fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir: rootDir, LazySelect: true, WriterLock: fsstorage.WriterLockOnSelect, WriterLockNoWait: true,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(t.Context(), logID))
+	store = newStore(fsstorage.RecoveryRepair)
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	assert.Equal(t, fsstorage.ActionReported, store.Selected.RecoveryFindings[0].Action)
+	assert.FileExists(t, tmp)
+	require.NoError(t, writer.Close())
+
+	store = newStore(fsstorage.RecoveryRepair)
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	assert.Equal(t, fsstorage.ActionRepaired, store.Selected.RecoveryFindings[0].Action)
+	assert.NoFileExists(t, tmp)
+}
+
+func TestRecovery_truncatesTornMassif(t *testing.T) {
+	l, writer := newTestLog(t, fsstorage.FSOptions{}, 2)
+	massifPath := l.path(t, writer, 1, storage.ObjectMassifData)
+
+	// a partially appended value
+	f, err := os.OpenFile(massifPath, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("torn"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	newStore := func(policy fsstorage.RecoveryPolicy) *fsstorage.CachingStore {
+		store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{Recovery: policy}))
+		require.NoError(t, err)
+		require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+		return store
+	}
+
+	store := newStore(fsstorage.RecoveryReport)
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	finding := store.Selected.RecoveryFindings[0]
+	assert.Equal(t, fsstorage.IssueTornMassif, finding.Issue)
+	assert.Equal(t, fsstorage.ActionReported, finding.Action)
+	assert.Equal(t, massifPath, finding.Path)
+	_, err = store.MassifReadN(t.Context(), 1, -1)
+	require.Error(t, err, "the torn massif is excluded")
+
+	store = newStore(fsstorage.RecoveryRepair)
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	assert.Equal(t, fsstorage.ActionRepaired, store.Selected.RecoveryFindings[0].Action)
+	data, err := store.MassifReadN(t.Context(), 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, l.Massifs[1], data)
+}
+
+func TestRecovery_checkpointBeyondData(t *testing.T) {
+	l, writer := newTestLog(t, fsstorage.FSOptions{}, 2)
+	massifPath := l.path(t, writer, 1, storage.ObjectMassifData)
+	checkpointPath := l.path(t, writer, 1, storage.ObjectCheckpoint)
+
+	// lose the last value, the massif is complete but behind its checkpoint
+	require.NoError(t, os.Truncate(massifPath, int64(len(l.Massifs[1])-massifs.ValueBytes)))
+
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{Recovery: fsstorage.RecoveryReport}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	finding := store.Selected.RecoveryFindings[0]
+	assert.Equal(t, fsstorage.IssueCheckpointAhead, finding.Issue)
+	assert.Equal(t, checkpointPath, finding.Path)
+
+	// there is no repair for the checkpoint, so it is quarantined
+	store, err = fsstorage.NewStore(t.Context(), l.Options(fsstorage.FSOptions{Recovery: fsstorage.RecoveryRepair}))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	require.Len(t, store.Selected.RecoveryFindings, 1)
+	finding = store.Selected.RecoveryFindings[0]
+	assert.Equal(t, fsstorage.ActionQuarantined, finding.Action)
+	assert.NoFileExists(t, checkpointPath)
+	quarantined, err := os.ReadFile(finding.QuarantinePath)
+	require.NoError(t, err)
+	assert.Equal(t, l.Checkpoints[1], quarantined)
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleCheck_discoversExternalWrites(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	ctx := t.Context()
+
+	writer, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir}})
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+
+	var events []fsstorage.RefreshEvent
+	readerOpts := fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir:            rootDir,
+		LazySelect:         true,
+		StaleCheckInterval: time.Nanosecond,
+		OnRefresh:          func(e fsstorage.RefreshEvent) { events = append(events, e) },
+	}}
+	reader, err := fsstorage.NewStore(ctx, readerOpts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(ctx, logID))
+
+	head, err := reader.HeadIndex(ctx, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), head)
+	assert.Empty(t, events)
+
+	require.NoError(t, writer.Put(ctx, 1, storage.ObjectCheckpoint, []byte("seal 1"), true))
+
+	// Directory modification times may have a coarse granularity
+	require.Eventually(t, func() bool {
+		head, err = reader.HeadIndex(ctx, storage.ObjectCheckpoint)
+		require.NoError(t, err)
+		return head == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, events, 1)
+	assert.Equal(t, []uint32{1}, events[0].NewSeals)
+}
+
+func TestStaleCheck_relistsWithinTheMTimeGranularity(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	ctx := t.Context()
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, LazySelect: true}}
+	writer, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+
+	reader, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(ctx, logID))
+
+	// a file created in the same modification time tick as the listing
+	require.NoError(t, writer.Put(ctx, 1, storage.ObjectCheckpoint, []byte("seal 1"), true))
+	sealsDir, err := reader.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	mtime := time.Unix(0, reader.Selected.SealsMTime)
+	require.NoError(t, os.Chtimes(sealsDir, mtime, mtime))
+
+	// a listing made well after the modification time is trusted
+	reader.Selected.ListedAt = mtime.Add(time.Hour)
+	_, err = reader.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), reader.Selected.HeadSealIndex)
+
+	reader.Selected.ListedAt = mtime
+	event, err := reader.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, event.NewSeals)
+	assert.Equal(t, uint32(1), reader.Selected.HeadSealIndex)
+}
+
+func TestStaleCheck_forgetsRemovedFiles(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+	ctx := t.Context()
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, LazySelect: true}}
+	writer, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.Put(ctx, 0, storage.ObjectCheckpoint, []byte("seal 0"), true))
+	require.NoError(t, writer.Put(ctx, 1, storage.ObjectCheckpoint, []byte("seal 1"), true))
+
+	reader, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, reader.SelectLog(ctx, logID))
+	require.Equal(t, uint32(1), reader.Selected.HeadSealIndex)
+
+	sealsDir, err := reader.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	removed, err := storage.ObjectPath(sealsDir, logID, 1, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(removed))
+
+	event, err := reader.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, []string{removed}, event.Removed)
+	assert.Equal(t, uint32(0), reader.Selected.HeadSealIndex)
+	_, err = reader.CheckpointRead(ctx, 1)
+	assert.ErrorIs(t, err, storage.ErrDoesNotExist)
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog-provider-testing/mmrtesting"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/veraison/go-cose"
+)
+
+// testMassifHeight keeps the test logs small
+const testMassifHeight = 3
+
+// testLog is a log of real massifs and signed checkpoints, committed through
+// a massifs.MassifCommitter as the provider tests do, for tests which need
+// content the store can decode.
+type testLog struct {
+	TC    *TestContext
+	LogID storage.LogID
+	// Massifs and Checkpoints hold the committed content, by massif index
+	Massifs     [][]byte
+	Checkpoints [][]byte
+
+	leaves uint64
+	key    *ecdsa.PrivateKey
+	signer cose.Signer
+}
+
+// newTestLog commits leaves to a new log under the root dir of a new test
+// context, through a store with the given options, until the log has
+// massifCount full massifs, each sealed by a checkpoint. The store is
+// returned with the log selected.
+func newTestLog(t *testing.T, fsopts fsstorage.FSOptions, massifCount uint32) (*testLog, *fsstorage.CachingStore) {
+	t.Helper()
+	tc := NewDefaultTestContext(t, mmrtesting.WithTestLabelPrefix(t.Name()))
+	id := uuid.New()
+	l := &testLog{TC: tc, LogID: storage.LogID(id[:])}
+
+	var err error
+	l.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	l.signer, err = cose.NewSigner(cose.AlgorithmES256, l.key)
+	require.NoError(t, err)
+
+	store, err := fsstorage.NewStore(t.Context(), l.Options(fsopts))
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(t.Context(), l.LogID))
+	l.fill(store, massifCount)
+	return l, store
+}
+
+// Options returns the options for a store of the test log. The root dir is
+// the test context root dir, unless fsopts has one.
+func (l *testLog) Options(fsopts fsstorage.FSOptions) fsstorage.Options {
+	if fsopts.RootDir == "" {
+		fsopts.RootDir = l.TC.Cfg.RootDir
+	}
+	return fsstorage.Options{
+		StorageOptions: massifs.StorageOptions{MassifHeight: testMassifHeight},
+		FSOptions:      fsopts,
+	}
+}
+
+// fill commits leaves through the store until the log has massifCount full
+// massifs, sealing each massif as the committer moves on from it.
+func (l *testLog) fill(store *fsstorage.CachingStore, massifCount uint32) {
+	t := l.TC.T
+	ctx := t.Context()
+	committer := massifs.NewMassifCommitter(massifs.MassifCommitterConfig{}, l.TC.Log, store)
+
+	var last *massifs.MassifContext
+	for {
+		mc, err := committer.GetAppendContext(ctx)
+		require.NoError(t, err)
+		if last != nil && mc.Start.MassifIndex != last.Start.MassifIndex {
+			l.seal(store, last)
+		}
+		if mc.Start.MassifIndex >= massifCount {
+			return
+		}
+		args := l.TC.G.EncodeLeafForAddition(l.TC.G.GenerateLeafContent(l.LogID, 0, l.leaves))
+		_, err = mc.AddHashedLeaf(sha256.New(), args.ID, nil, args.LogID, args.AppID, args.Value)
+		require.NoError(t, err)
+		require.NoError(t, committer.CommitContext(ctx, mc))
+		l.leaves++
+		last = mc
+	}
+}
+
+// seal puts a signed checkpoint for the committed state of the massif
+func (l *testLog) seal(store *fsstorage.CachingStore, mc *massifs.MassifContext) {
+	t := l.TC.T
+	state := massifs.MMRState{MMRSize: mc.RangeCount(), Timestamp: time.Now().UnixMilli()}
+	data, err := l.checkpoint(state)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(t.Context(), mc.Start.MassifIndex, storage.ObjectCheckpoint, data, true))
+
+	for uint32(len(l.Massifs)) <= mc.Start.MassifIndex {
+		l.Massifs = append(l.Massifs, nil)
+		l.Checkpoints = append(l.Checkpoints, nil)
+	}
+	l.Massifs[mc.Start.MassifIndex] = bytes.Clone(mc.Data)
+	l.Checkpoints[mc.Start.MassifIndex] = data
+}
+
+// checkpoint returns a signed checkpoint for the state
+func (l *testLog) checkpoint(state massifs.MMRState) ([]byte, error) {
+	codec, err := massifs.NewCBORCodec()
+	if err != nil {
+		return nil, err
+	}
+	signer := massifs.NewRootSigner("https://test.example", codec)
+	return signer.Sign1(l.signer, "test-key", &l.key.PublicKey, uuid.UUID(l.LogID).String(), state, nil)
+}
+
+// path returns the path of the object in the log, as named by the store
+func (l *testLog) path(t *testing.T, store *fsstorage.CachingStore, massifIndex uint32, ty storage.ObjectType) string {
+	prefix, err := store.PrefixPath(ty)
+	require.NoError(t, err)
+	storagePath, err := storage.ObjectPath(prefix, l.LogID, massifIndex, ty)
+	require.NoError(t, err)
+	return storagePath
+}
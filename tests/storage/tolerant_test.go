@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopulateCache_quarantinesCorruptFiles(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	logDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String())
+	massifsDir := filepath.Join(logDir, fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(massifsDir, "0000000000000000.log"), []byte("not read"), 0644))
+	// not canonically named, so it is read when the log is selected, and it is empty
+	require.NoError(t, os.WriteFile(filepath.Join(massifsDir, "broken.log"), nil, 0644))
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir:      rootDir,
+		LazySelect:   true,
+		CorruptFiles: fsstorage.CorruptFileQuarantine,
+	}}
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SelectLog(ctx, logID))
+	corrupt, err := store.CorruptFiles()
+	require.NoError(t, err)
+	require.NotNil(t, corrupt)
+	require.ErrorIs(t, corrupt, fsstorage.ErrCorruptFiles)
+	require.Len(t, corrupt.Files, 1)
+	assert.Equal(t, filepath.Join(massifsDir, "broken.log"), corrupt.Files[0].Path)
+	assert.Equal(t, filepath.Join(logDir, fsstorage.QuarantineDirName, "broken.log"), corrupt.Files[0].QuarantinePath)
+	_, err = os.Stat(corrupt.Files[0].QuarantinePath)
+	assert.NoError(t, err)
+
+	// the healthy massif remains usable
+	head, err := store.HeadIndex(ctx, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), head)
+
+	// once quarantined, the log selects cleanly
+	store, err = fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, logID))
+	corrupt, err = store.CorruptFiles()
+	require.NoError(t, err)
+	assert.Nil(t, corrupt)
+}
+
+func TestPopulateCache_skipsCorruptFilesWhileTheLockIsHeld(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	massifsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	brokenPath := filepath.Join(massifsDir, "broken.log")
+	require.NoError(t, os.WriteFile(brokenPath, nil, 0644))
+
+	// another writer holds the lock
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{RootDir: rootDir, CorruptFiles: fsstorage.CorruptFileSkip}}
+	writer, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, writer.SelectLog(ctx, logID))
+	require.NoError(t, writer.TryLockLog())
+
+	opts.CorruptFiles = fsstorage.CorruptFileQuarantine
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.SelectLog(ctx, logID))
+	corrupt, err := store.CorruptFiles()
+	require.NoError(t, err)
+	require.NotNil(t, corrupt)
+	require.Len(t, corrupt.Files, 1)
+	assert.Empty(t, corrupt.Files[0].QuarantinePath)
+	assert.FileExists(t, brokenPath)
+}
+
+func TestPopulateCache_skipsCorruptFilesOnInitAndForHandles(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := t.Context()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	massifsDir := filepath.Join(rootDir, fsstorage.LogIDPrefix, id.String(), fsstorage.MassifsDirName)
+	require.NoError(t, os.MkdirAll(massifsDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(massifsDir, "broken.log"), nil, 0644))
+
+	opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir:      rootDir,
+		CorruptFiles: fsstorage.CorruptFileSkip,
+	}}
+	opts.LogID = logID
+	store, err := fsstorage.NewStore(ctx, opts)
+	require.NoError(t, err)
+	corrupt, err := store.CorruptFiles()
+	require.NoError(t, err)
+	require.NotNil(t, corrupt)
+	assert.Len(t, corrupt.Files, 1)
+
+	h, err := store.Log(ctx, logID)
+	require.NoError(t, err)
+	corrupt, err = h.CorruptFiles()
+	require.NoError(t, err)
+	require.NotNil(t, corrupt)
+	assert.Equal(t, filepath.Join(massifsDir, "broken.log"), corrupt.Files[0].Path)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPut_detectsConflictingWrite(t *testing.T) {
+	store, logID := newTempDirStore(t)
+	ctx := t.Context()
+
+	prefix, err := store.PrefixPath(storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	storagePath, err := storage.ObjectPath(prefix, logID, 0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("aaaa"), true))
+	v, ok := store.Version(0, storage.ObjectCheckpoint)
+	require.True(t, ok)
+	assert.Equal(t, int64(4), v.Size)
+
+	// Replace the content behind the store's back, preserving size and mtime
+	// so that only the content hash can tell the difference.
+	require.NoError(t, os.WriteFile(storagePath, []byte("bbbb"), 0644))
+	require.NoError(t, os.Chtimes(storagePath, v.ModTime, v.ModTime))
+
+	err = store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("cccc"), false)
+	require.ErrorIs(t, err, fsstorage.ErrWriteConflict)
+	var conflict *fsstorage.WriteConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, storagePath, conflict.Path)
+
+	data, err := os.ReadFile(storagePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bbbb"), data)
+
+	// removing the object is also a conflict
+	require.NoError(t, os.Remove(storagePath))
+	err = store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("cccc"), false)
+	require.ErrorAs(t, err, &conflict)
+	assert.Nil(t, conflict.Actual)
+}
+
+func TestPut_holdsWriterLockForTheWrite(t *testing.T) {
+	store, logID := newTempDirStore(t)
+	ctx := t.Context()
+
+	other, err := fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir: store.Opts.RootDir, LazySelect: true, WriterLock: fsstorage.WriterLockOnSelect, WriterLockNoWait: true,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, other.SelectLog(ctx, logID))
+
+	// the store does not take the lock on select, but waits for it to Put
+	putCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = store.Put(putCtx, 0, storage.ObjectCheckpoint, []byte("aaaa"), true)
+	require.ErrorIs(t, err, fsstorage.ErrLockHeld)
+	_, ok := store.Version(0, storage.ObjectCheckpoint)
+	assert.False(t, ok)
+
+	require.NoError(t, other.Close())
+	require.NoError(t, store.Put(ctx, 0, storage.ObjectCheckpoint, []byte("aaaa"), true))
+
+	// and releases it again afterwards
+	other, err = fsstorage.NewStore(ctx, fsstorage.Options{FSOptions: fsstorage.FSOptions{
+		RootDir: store.Opts.RootDir, LazySelect: true, WriterLock: fsstorage.WriterLockOnSelect, WriterLockNoWait: true,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, other.SelectLog(ctx, logID))
+	require.NoError(t, other.Close())
+}
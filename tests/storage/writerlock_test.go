@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	fsstorage "github.com/forestrie/go-merklelog-fs/storage"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterLock_exclusiveAcrossStores(t *testing.T) {
+	rootDir := t.TempDir()
+	id := uuid.New()
+	logID := storage.LogID(id[:])
+
+	newStore := func(mode fsstorage.WriterLockMode) *fsstorage.CachingStore {
+		opts := fsstorage.Options{FSOptions: fsstorage.FSOptions{
+			RootDir: rootDir, WriterLock: mode, WriterLockNoWait: true,
+		}}
+		store, err := fsstorage.NewStore(t.Context(), opts)
+		require.NoError(t, err)
+		return store
+	}
+
+	first := newStore(fsstorage.WriterLockOnSelect)
+	require.NoError(t, first.SelectLog(t.Context(), logID))
+
+	second := newStore(fsstorage.WriterLockOnSelect)
+	err := second.SelectLog(t.Context(), logID)
+	require.ErrorIs(t, err, fsstorage.ErrLockHeld)
+	var held *fsstorage.LockHeldError
+	require.ErrorAs(t, err, &held)
+	assert.Equal(t, os.Getpid(), held.PID)
+	assert.False(t, held.Stale)
+
+	// the log the lock was not taken for is not left selected for writing
+	err = second.Put(t.Context(), 0, storage.ObjectCheckpoint, []byte("aaaa"), true)
+	require.ErrorIs(t, err, storage.ErrLogNotSelected)
+
+	// a blocking acquire gives up when the context is done
+	third := newStore(fsstorage.WriterLockNone)
+	require.NoError(t, third.SelectLog(t.Context(), logID))
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err = third.LockLog(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, fsstorage.ErrLockHeld)
+
+	require.NoError(t, first.Close())
+	require.NoError(t, second.SelectLog(t.Context(), logID))
+	require.NoError(t, second.Close())
+	require.NoError(t, third.Close())
+}